@@ -4,11 +4,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/url"
 
-	"github.com/russross/blackfriday"
 	"gopkg.in/yaml.v2"
 )
 
@@ -53,6 +51,10 @@ type Assignment struct {
 	AssignmentGroupId int    `json:"assignment_group_id" yaml:"assignment_group_id" meddler:"assignment_group_id"` // the ID of the assignment's group
 	QuizId            int    `json:"quiz_id" yaml:"quiz_id" meddler:"quiz_id"`                                     // (Optional) id of the associated quiz (applies only when submission_types is ['online_quiz'])
 
+	// The local name of the assignment's group. This is what gets pushed, since
+	// the ids differ in every course.
+	AssignmentGroup string `json:"-" yaml:"assignment_group,omitempty" meddler:"-"`
+
 	// the due date for the assignment. returns null if not present. NOTE: If this
 	// assignment has assignment overrides, this field will be the due date as it
 	// applies to the user requesting information from the API.
@@ -144,67 +146,101 @@ type RubricCriterion struct {
 	Points          int    `json:"points" yaml:"points" meddler:"points"`
 }
 
-func getAssignments(db *sql.DB) []*Assignment {
+func getAssignments(client *CanvasClient, course *Course) ([]*Assignment, error) {
 	assignments := make([]*Assignment, 0)
-	courses, _ := findCourses(db)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	reqUrl := fmt.Sprintf(assignmentsPath, courseId)
-	mustGetObject(reqUrl, values, &assignments)
-	return assignments
+	reqUrl := fmt.Sprintf(assignmentsPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &assignments)
+	return assignments, err
 }
 
-func pullAssignments(db *sql.DB) {
-	assignments := getAssignments(db)
+func listAssignments(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	assignments, err := getAssignments(client, course)
 	for _, assignment := range assignments {
-		assignment.Pull(db)
+		components = append(components, assignment)
 	}
+	return components, err
+}
+
+func pullAssignments(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listAssignments, assignmentPath)
 }
 
-func pushAssignment(db *sql.DB, filepath string) error {
+func readAssignmentFile(filepath string) (Component, error) {
 	assignment := new(Assignment)
-	_, err := readFile(filepath, assignment)
-	if err != nil {
-		return err
-	}
-	return assignment.Push(db)
+	description, err := readFile(filepath, assignment)
+	assignment.Description = description
+	return assignment, err
 }
 
-func pushAssignments(db *sql.DB) {
-	files, err := ioutil.ReadDir(assignmentsDir)
+func pushAssignment(client *CanvasClient, db *sql.DB, courses []*Course, filepath string, out io.Writer) error {
+	assignment, err := readAssignmentFile(filepath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return assignment.(*Assignment).Push(client, db, courses, out)
+}
 
-	for _, f := range files {
-		filepath := f.Name()
-		err = pushAssignment(db, filepath)
-		if err != nil {
-			log.Fatalf("Failed to push assignment %s: %v\n", filepath, err)
-		}
-	}
+func (assignment *Assignment) ComponentType() string {
+	return "assignment"
 }
 
-func (assignment *Assignment) Dump() error {
+func (assignment *Assignment) Dump(db *sql.DB) error {
 	metadata, err := yaml.Marshal(assignment)
 	if err != nil {
 		return err
 	}
-	assignmentFilePath := fmt.Sprintf("%s/%s.md", assignmentsDir, assignment.Slug())
-	return writeFile(assignmentFilePath, string(metadata), assignment.Description)
+	return writeFile(db, assignment.Filepath(), string(metadata), assignment.Description)
 }
 
-func (assignment *Assignment) Pull(db *sql.DB) error {
-	return pullComponent(db, assignmentPath, assignment.CanvasId, assignment)
+func (assignment *Assignment) htmlBody() string {
+	return assignment.Description
 }
 
-// For now, pushing only creates assignments. Later, we'll have to track whether
-// an assignment already exists before pushing it to either create or update it.
-// The difference is that assignments have separate API endpoints for the two
-// actions whereas pages do not.
-func (assignment *Assignment) Push(db *sql.DB) error {
+func (assignment *Assignment) Filepath() string {
+	return fmt.Sprintf("%s/%s.md", assignmentsDir, assignment.Slug())
+}
+
+func (assignment *Assignment) GetCanvasId() int {
+	return assignment.CanvasId
+}
+
+func (assignment *Assignment) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, assignmentPath, assignment)
+}
+
+// Finds the id of this assignment in the given course. Uses the id recorded in
+// the db if there is one, otherwise searches the course's assignments for one
+// with the same name or integration id. Returns 0 if the assignment doesn't
+// exist in the course yet.
+func (assignment *Assignment) findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error) {
+	canvasId, err := findCanvasId(db, assignment.ComponentType(), assignment.Slug(), course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	values := url.Values{}
+	values.Add("per_page", "100")
+	values.Add("search_term", assignment.Name)
+	p := client.newPager(fmt.Sprintf(assignmentsPath, course.CanvasId), values)
+	var candidates []*Assignment
+	for p.Next(&candidates) {
+		for _, candidate := range candidates {
+			if candidate.Name == assignment.Name ||
+				(assignment.IntegrationId != "" && candidate.IntegrationId == assignment.IntegrationId) {
+				return candidate.CanvasId, nil
+			}
+		}
+	}
+	return 0, p.Err()
+}
+
+// Pushes the assignment to the given courses, updating it if it already exists there
+// and creating it otherwise. Unlike pages, assignments have separate API
+// endpoints for the two actions, so we have to know which one we need.
+func (assignment *Assignment) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
 	// Convert struct to map
 	marshalled, err := json.Marshal(assignment)
 	if err != nil {
@@ -217,12 +253,12 @@ func (assignment *Assignment) Push(db *sql.DB) error {
 	}
 
 	// fix a few fields
-	assignmentMap["description"] = string(blackfriday.MarkdownCommon([]byte(assignment.Description)))
+	assignmentMap["description"] = renderMarkdown(assignment.Description)
 	invalidFields := []string{"updated_at", "created_at", "id", "html_url",
 		"submissions_download_url", "course_id", "anonymous_submissions",
 		"discussion_topic", "intra_group_peer_reviews", "needs_grading_count",
 		"peer_review_count", "peer_reviews_assign_at", "quiz_id", "rubric",
-		"rubric_settings", "use_rubric_for_grading"}
+		"rubric_settings", "use_rubric_for_grading", "assignment_group_id"}
 	for _, field := range invalidFields {
 		delete(assignmentMap, field)
 	}
@@ -231,16 +267,50 @@ func (assignment *Assignment) Push(db *sql.DB) error {
 		"assignment": assignmentMap,
 	}
 
-	courses, _ := findCourses(db)
 	for _, course := range courses {
-		courseId := course.CanvasId
-		createAssignmentPath := fmt.Sprintf(assignmentsPath, courseId)
-		fmt.Printf("Pushing %s to %s\n", assignment.Name, course.Name)
-		mustPostObject(createAssignmentPath, url.Values{}, a, nil)
+		canvasId, err := assignment.findCanvasId(client, db, course)
+		if err != nil {
+			return err
+		}
+		if assignment.AssignmentGroup != "" {
+			groupId, err := findAssignmentGroupId(client, db, course, assignment.AssignmentGroup)
+			if err != nil {
+				return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+			}
+			assignmentMap["assignment_group_id"] = groupId
+		}
+
+		pushed := new(Assignment)
+		_, err = updateOrCreate(client, db, course, assignment, canvasId, out, func(canvasId int) error {
+			updateAssignmentPath := fmt.Sprintf(assignmentPath, course.CanvasId, canvasId)
+			fmt.Fprintf(out, "Updating %s in %s\n", assignment.Name, course.Name)
+			return client.putObject(updateAssignmentPath, url.Values{}, a, pushed)
+		}, func() error {
+			createAssignmentPath := fmt.Sprintf(assignmentsPath, course.CanvasId)
+			fmt.Fprintf(out, "Creating %s in %s\n", assignment.Name, course.Name)
+			return client.postObject(createAssignmentPath, url.Values{}, a, pushed)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+		if err := recordPush(client, db, course, assignment, pushed); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Gets the name of the assignment's group from the same course the assignment
+// came from, so it can be put in the same group in every course.
+func (assignment *Assignment) pullParts(client *CanvasClient, db *sql.DB, course *Course) error {
+	if assignment.AssignmentGroupId == 0 {
+		return nil
+	}
+	name, err := assignmentGroupSlug(client, course, assignment.AssignmentGroupId)
+	assignment.AssignmentGroup = name
+	return err
+}
+
 func (assignment *Assignment) Slug() string {
 	return slug(assignment.Name)
 }
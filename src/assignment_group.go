@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"net/url"
 
 	"gopkg.in/yaml.v2"
@@ -19,38 +20,206 @@ type AssignmentGroup struct {
 	Name        string  `json:"name" yaml:"name" meddler:"name"`
 	Position    int     `json:"position" yaml:"position" meddler:"position"`
 	GroupWeight float64 `json:"group_weight" yaml:"group_weight" meddler:"group_weight"`
+	// which scores are dropped when calculating the grade for the group
+	Rules AssignmentGroupRules `json:"rules" yaml:"rules" meddler:"rules"`
 }
 
-func getAssignmentGroups(db *sql.DB) []*AssignmentGroup {
+type AssignmentGroupRules struct {
+	DropLowest  int `json:"drop_lowest,omitempty" yaml:"drop_lowest,omitempty"`   // how many of the lowest scores to drop
+	DropHighest int `json:"drop_highest,omitempty" yaml:"drop_highest,omitempty"` // how many of the highest scores to drop
+	// the ids of assignments that are never dropped
+	NeverDrop []int `json:"never_drop,omitempty" yaml:"-"`
+	// The local names of the assignments that are never dropped. These are what
+	// get pushed, since the ids differ in every course.
+	NeverDropAssignments []string `json:"-" yaml:"never_drop,omitempty"`
+}
+
+func getAssignmentGroups(client *CanvasClient, course *Course) ([]*AssignmentGroup, error) {
 	ags := make([]*AssignmentGroup, 0)
-	courses, _ := findCourses(db)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	reqUrl := fmt.Sprintf(assignmentGroupsPath, courseId)
-	mustGetObject(reqUrl, values, &ags)
-	return ags
+	reqUrl := fmt.Sprintf(assignmentGroupsPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &ags)
+	return ags, err
+}
+
+func readAssignmentGroupFile(filepath string) (Component, error) {
+	ag := new(AssignmentGroup)
+	err := readYamlFile(filepath, ag)
+	return ag, err
 }
 
-func pullAssignmentGroups(db *sql.DB) {
-	ags := getAssignmentGroups(db)
+func listAssignmentGroups(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	ags, err := getAssignmentGroups(client, course)
 	for _, ag := range ags {
-		ag.Dump()
+		components = append(components, ag)
+	}
+	return components, err
+}
+
+func pullAssignmentGroups(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listAssignmentGroups, assignmentGroupPath)
+}
+
+func pushAssignmentGroup(client *CanvasClient, db *sql.DB, courses []*Course, filepath string, out io.Writer) error {
+	ag, err := readAssignmentGroupFile(filepath)
+	if err != nil {
+		return err
 	}
+	return ag.(*AssignmentGroup).Push(client, db, courses, out)
 }
 
-func (ag *AssignmentGroup) Dump() error {
+// applyGroupWeights turns on weighting final grades by assignment group in the
+// given courses, so the groups' weights take effect.
+func applyGroupWeights(client *CanvasClient, courses []*Course) {
+	c := map[string]interface{}{
+		"course": map[string]interface{}{
+			"apply_assignment_group_weights": true,
+		},
+	}
+	for _, course := range courses {
+		fmt.Printf("Weighting grades by assignment group in %s\n", course.Name)
+		if err := client.putObject(fmt.Sprintf(coursePath, course.CanvasId), url.Values{}, c, nil); err != nil {
+			recordFailure("apply assignment group weights in "+course.Name, err)
+		}
+	}
+}
+
+// assignmentGroupSlug returns the local name of the assignment group with the
+// given id in a course, for components that belong to one.
+func assignmentGroupSlug(client *CanvasClient, course *Course, canvasId int) (string, error) {
+	ag := new(AssignmentGroup)
+	found, err := client.findObject(fmt.Sprintf(assignmentGroupPath, course.CanvasId, canvasId), url.Values{}, ag)
+	if err != nil || !found {
+		return "", err
+	}
+	return ag.Slug(), nil
+}
+
+// findAssignmentGroupId finds the id the given course uses for the assignment
+// group with the given local name. Components that belong to a group use this
+// to put themselves in the course's copy of it.
+func findAssignmentGroupId(client *CanvasClient, db *sql.DB, course *Course, name string) (int, error) {
+	return findLinkedId(client, db, course, "assignment_group", name, assignmentGroupsDir, ".md", readAssignmentGroupFile)
+}
+
+func (ag *AssignmentGroup) ComponentType() string {
+	return "assignment_group"
+}
+
+func (ag *AssignmentGroup) Dump(db *sql.DB) error {
 	metadata, err := yaml.Marshal(ag)
 	if err != nil {
 		return err
 	}
-	assignmentGroupFilePath := fmt.Sprintf("%s/%s.md", assignmentGroupsDir, ag.Slug())
-	return writeYamlFile(assignmentGroupFilePath, string(metadata))
+	return writeYamlFile(db, ag.Filepath(), string(metadata))
+}
+
+func (ag *AssignmentGroup) Filepath() string {
+	return fmt.Sprintf("%s/%s.md", assignmentGroupsDir, ag.Slug())
+}
+
+func (ag *AssignmentGroup) GetCanvasId() int {
+	return ag.CanvasId
+}
+
+func (ag *AssignmentGroup) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, assignmentGroupPath, ag)
+}
+
+// Gets the names of the assignments that are never dropped from the same
+// course the group came from, so the rules can be pushed to any course.
+func (ag *AssignmentGroup) pullParts(client *CanvasClient, db *sql.DB, course *Course) error {
+	if len(ag.Rules.NeverDrop) == 0 {
+		return nil
+	}
+	assignments, err := getAssignments(client, course)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	for _, assignment := range assignments {
+		names[assignment.CanvasId] = assignment.Slug()
+	}
+	ag.Rules.NeverDropAssignments = make([]string, 0, len(ag.Rules.NeverDrop))
+	for _, id := range ag.Rules.NeverDrop {
+		if name, ok := names[id]; ok {
+			ag.Rules.NeverDropAssignments = append(ag.Rules.NeverDropAssignments, name)
+		}
+	}
+	return nil
 }
 
-func (ag *AssignmentGroup) Pull(db *sql.DB) error {
-	return pullComponent(db, assignmentGroupPath, ag.CanvasId, ag)
+// Finds the id of this group in the given course. Uses the id recorded in the
+// db if there is one, otherwise looks through the course's groups for one with
+// the same name. Returns 0 if the group doesn't exist in the course yet.
+func (ag *AssignmentGroup) findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error) {
+	canvasId, err := findCanvasId(db, ag.ComponentType(), ag.Slug(), course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	ags, err := getAssignmentGroups(client, course)
+	if err != nil {
+		return 0, err
+	}
+	for _, candidate := range ags {
+		if candidate.Name == ag.Name {
+			return candidate.CanvasId, nil
+		}
+	}
+	return 0, nil
+}
+
+// Pushes the group and its rules to the given courses, creating it where it
+// doesn't exist yet. Assignments that are never dropped have to be in a course
+// to be named in its rules; any that aren't yet are left out until the group
+// is pushed again.
+func (ag *AssignmentGroup) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
+	for _, course := range courses {
+		canvasId, err := ag.findCanvasId(client, db, course)
+		if err != nil {
+			return err
+		}
+
+		neverDrop := make([]int, 0, len(ag.Rules.NeverDropAssignments))
+		for _, name := range ag.Rules.NeverDropAssignments {
+			id, err := findLinkedId(client, db, course, "assignment", name, assignmentsDir, ".md", readAssignmentFile)
+			if err != nil {
+				fmt.Fprintf(out, "  leaving %s out of never_drop in %s: %v\n", name, course.Name, err)
+				continue
+			}
+			neverDrop = append(neverDrop, id)
+		}
+		// Canvas takes the group's fields as they are, without wrapping them
+		g := map[string]interface{}{
+			"name":         ag.Name,
+			"position":     ag.Position,
+			"group_weight": ag.GroupWeight,
+			"rules": map[string]interface{}{
+				"drop_lowest":  ag.Rules.DropLowest,
+				"drop_highest": ag.Rules.DropHighest,
+				"never_drop":   neverDrop,
+			},
+		}
+
+		pushed := new(AssignmentGroup)
+		_, err = updateOrCreate(client, db, course, ag, canvasId, out, func(canvasId int) error {
+			fmt.Fprintf(out, "Updating %s in %s\n", ag.Name, course.Name)
+			return client.putObject(fmt.Sprintf(assignmentGroupPath, course.CanvasId, canvasId), url.Values{}, g, pushed)
+		}, func() error {
+			fmt.Fprintf(out, "Creating %s in %s\n", ag.Name, course.Name)
+			return client.postObject(fmt.Sprintf(assignmentGroupsPath, course.CanvasId), url.Values{}, g, pushed)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+		if err := recordPush(client, db, course, ag, pushed); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (ag *AssignmentGroup) Slug() string {
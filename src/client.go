@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// CanvasClient talks to the API of a single Canvas instance.
+type CanvasClient struct {
+	BaseUrl    string // e.g., https://canvas.example.edu/api/v1
+	Token      string
+	OAuth      *oauthSource // hands out access tokens instead of Token, if set
+	HttpClient *http.Client
+	Logger     *log.Logger
+	Limiter    *rateLimiter
+
+	Report     bool          // log every request
+	Dump       bool          // log request and response data
+	DryRun     bool          // print requests that would change Canvas instead of sending them
+	Retries    int           // how many times to retry a request that failed temporarily
+	MaxBackoff time.Duration // the longest to wait between retries
+}
+
+// NewCanvasClient creates a client for the Canvas instance at the given host.
+// The host can include a scheme, e.g., http://localhost:3000 for a server
+// standing in for Canvas; otherwise https is used.
+func NewCanvasClient(host, token string) *CanvasClient {
+	return &CanvasClient{
+		BaseUrl:    hostUrl(host) + urlPrefix,
+		Token:      token,
+		HttpClient: http.DefaultClient,
+		Logger:     log.New(os.Stderr, "", log.Ltime),
+		Limiter:    newRateLimiter(),
+		Retries:    defaultRetries,
+		MaxBackoff: defaultMaxBackoff,
+	}
+}
+
+// newClient creates the client for the Canvas instance the user logged in to,
+// set up by the command line flags.
+func newClient() *CanvasClient {
+	client := NewCanvasClient(Config.Host, Config.Token)
+	client.OAuth = Config.oauth
+	client.Report = Config.apiReport
+	client.Dump = Config.apiDump
+	client.DryRun = Config.dryRun
+	client.Retries = Config.retries
+	client.MaxBackoff = Config.maxBackoff
+
+	switch {
+	case Config.record != "" && Config.replay != "":
+		log.Fatalf("--record and --replay cannot be used together")
+	case Config.record != "":
+		recorder, err := newRecorder(http.DefaultTransport, Config.record)
+		if err != nil {
+			log.Fatalf("Failed to set up recording: %v", err)
+		}
+		client.HttpClient = &http.Client{Transport: recorder}
+	case Config.replay != "":
+		replayer, err := newReplayer(Config.replay)
+		if err != nil {
+			log.Fatalf("Failed to load fixtures: %v", err)
+		}
+		client.HttpClient = &http.Client{Transport: replayer}
+		// a missing fixture won't turn up by trying again
+		client.Retries = 0
+	}
+	return client
+}
+
+// getObject GETs the object at the given path into download.
+func (c *CanvasClient) getObject(path string, params url.Values, download interface{}) error {
+	return c.doRequest(path, params, "GET", nil, download)
+}
+
+// findObject is like getObject, but it isn't an error for the object to be
+// missing from Canvas. Reports whether the object was found.
+func (c *CanvasClient) findObject(path string, params url.Values, download interface{}) (bool, error) {
+	err := c.getObject(path, params, download)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *CanvasClient) postObject(path string, params url.Values, upload interface{}, download interface{}) error {
+	return c.doRequest(path, params, "POST", upload, download)
+}
+
+func (c *CanvasClient) putObject(path string, params url.Values, upload interface{}, download interface{}) error {
+	return c.doRequest(path, params, "PUT", upload, download)
+}
+
+func (c *CanvasClient) deleteObject(path string, params url.Values) error {
+	return c.doRequest(path, params, "DELETE", nil, nil)
+}
+
+func (c *CanvasClient) prepareRequest(reqUrl string, params url.Values, method string, upload interface{}, download interface{}) (*http.Request, error) {
+	req, err := http.NewRequest(method, reqUrl, nil)
+	if err != nil {
+		return req, err
+	}
+
+	// add any parameters
+	if params != nil && len(params) > 0 {
+		req.URL.RawQuery = params.Encode()
+	}
+
+	if c.Report {
+		c.Logger.Printf("%s %s", method, req.URL)
+	}
+
+	// set the headers
+	token := c.Token
+	if c.OAuth != nil {
+		if token, err = c.OAuth.accessToken(); err != nil {
+			return req, err
+		}
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	if download != nil {
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Accept-Encoding", "gzip")
+	}
+
+	// upload the payload if any
+	if upload != nil && (method == "POST" || method == "PUT") {
+		req.Header.Add("Content-Type", "application/json")
+		payload := new(bytes.Buffer)
+		jw := json.NewEncoder(payload)
+		if err := jw.Encode(upload); err != nil {
+			return req, fmt.Errorf("JSON error encoding object to upload: %v", err)
+		}
+		req.Body = ioutil.NopCloser(payload)
+
+		if c.Dump {
+			c.Logger.Printf("Request data: %s", payload)
+		}
+	}
+	return req, nil
+}
+
+// doRequest sends a single request to Canvas and decodes the response into
+// download. Listings that span several pages go through a pager instead.
+func (c *CanvasClient) doRequest(path string, params url.Values, method string, upload interface{}, download interface{}) error {
+	if !strings.HasPrefix(path, "/") {
+		log.Panicf("doRequest path must start with /")
+	}
+	if method != "GET" && method != "POST" && method != "PUT" && method != "DELETE" {
+		log.Panicf("doRequest only recognizes GET, POST, PUT, and DELETE methods")
+	}
+
+	// a dry run still reads from Canvas, but only shows what it would change
+	if c.DryRun && method != "GET" {
+		return dumpDryRun(path, params, method, upload)
+	}
+
+	resp, err := c.sendRequest(c.BaseUrl+path, params, method, upload, download)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !isSuccess(resp) {
+		return c.newCanvasError(method, path, resp)
+	}
+	return c.parseResponse(resp, download)
+}
+
+// isSuccess reports whether the response has a 2xx status, e.g., 201 Created
+// when creating an assignment.
+func isSuccess(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func (c *CanvasClient) newCanvasError(method, path string, resp *http.Response) *CanvasError {
+	raw, err := readBody(resp)
+	if err == nil && c.Dump {
+		c.Logger.Printf("Response data: %s", raw)
+	}
+	return newCanvasError(method, path, resp, raw)
+}
+
+func dumpDryRun(path string, params url.Values, method string, upload interface{}) error {
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	fmt.Printf("[dry run] %s %s%s\n", method, urlPrefix, path)
+	if upload != nil {
+		raw, err := json.MarshalIndent(upload, "", "    ")
+		if err != nil {
+			return fmt.Errorf("JSON error encoding object to upload: %v", err)
+		}
+		fmt.Printf("%s\n", raw)
+	}
+	return nil
+}
+
+func (c *CanvasClient) parseResponse(resp *http.Response, download interface{}) error {
+	// parse the result if any
+	if download == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to decompress gzip result: %v", err)
+		}
+		body = gz
+		defer gz.Close()
+	}
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(download); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse result object from server: %v", err)
+	}
+
+	if c.Dump {
+		raw, err := json.MarshalIndent(download, "", "    ")
+		if err != nil {
+			return fmt.Errorf("JSON error encoding downloaded object: %v", err)
+		}
+		c.Logger.Printf("Response data: %s", raw)
+	}
+	return nil
+}
@@ -1,25 +1,676 @@
 package main
 
 import (
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/russross/meddler"
+)
+
+const (
+	componentCanvasIdsTable = "component_canvas_ids"
 )
 
 type Component interface {
-	Dump() error
+	Dump(db *sql.DB) error
+	Pull(client *CanvasClient, db *sql.DB, courses []*Course) error
+	// the type of component, e.g., "page" or "assignment"
+	ComponentType() string
+	// the local identity of the component, shared across all courses
+	Slug() string
+	// the id Canvas assigned to the component in the course it came from
+	GetCanvasId() int
+	// the local file the component is stored in
+	Filepath() string
+	// pushes the component to each of the courses
+	Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error
+}
+
+// Components with an html body, which is stored locally as markdown following
+// the yaml metadata
+type bodyComponent interface {
+	Component
+	htmlBody() string
+}
+
+// Components whose parts live at a separate endpoint (e.g., quiz questions)
+// implement this to pull those parts from the course the component came from.
+type partsPuller interface {
+	pullParts(client *CanvasClient, db *sql.DB, course *Course) error
+}
+
+// Components with parts that Canvas doesn't include when it lists them (e.g.,
+// quiz questions or module items) implement this so the parts count as part
+// of the component's remote state. A question edited in Canvas doesn't change
+// the quiz that holds it, so otherwise the edit would go unnoticed.
+type partsLister interface {
+	listParts(client *CanvasClient, course *Course) (interface{}, error)
+}
+
+// ComponentCanvasId maps a local component to the id Canvas uses for it in a
+// single course. Every section assigns its own ids, so a component will have
+// one of these per course it lives in. It also holds the state of both sides
+// the last time the component was synced with the course.
+type ComponentCanvasId struct {
+	Id            int    `meddler:"id,pk"`
+	ComponentType string `meddler:"component_type"`
+	ComponentId   string `meddler:"component_id"` // the component's slug
+	CourseId      int    `meddler:"course_id"`    // the local id of the course
+	CanvasId      int    `meddler:"canvas_id"`
+	UpdatedAt     string `meddler:"updated_at"`   // Canvas's updated_at at the last sync, if it has one
+	RemoteHash    string `meddler:"remote_hash"`  // hash of the Canvas object at the last sync
+	ContentHash   string `meddler:"content_hash"` // hash of the local file(s) at the last sync
+}
+
+// A type of component along with how to find it locally and in Canvas
+type componentKind struct {
+	name    string   // the name used on the command line, e.g., "pages"
+	aliases []string // other names accepted on the command line
+	dir     string
+	// reads a single component from its local file
+	load func(filepath string) (Component, error)
+	// lists all of the components of this type in a course
+	list func(client *CanvasClient, course *Course) ([]Component, error)
+	// the path to a single component in Canvas, formatted with the course's
+	// canvas id and the component's id
+	path string
+	// the type its components are recorded under, e.g., "page"
+	componentType string
+	// the order its components have to be pushed in, one at a time, if they
+	// can't all be pushed at once
+	pushOrder func(a, b Component) bool
+}
+
+var componentKinds = []componentKind{
+	{"assignments", []string{"assignment", "a"}, assignmentsDir, readAssignmentFile, listAssignments, assignmentPath, "assignment", nil},
+	{"assignment_groups", []string{"assignment_group", "ag"}, assignmentGroupsDir, readAssignmentGroupFile, listAssignmentGroups, assignmentGroupPath, "assignment_group", nil},
+	{"discussions", []string{"discussion", "d"}, discussionsDir, readDiscussionFile, listDiscussionTopics, discussionTopicPath, "discussion", nil},
+	{"modules", []string{"module", "m"}, modulesDir, readModuleFile, listModules, modulePath, "module", modulesByPosition},
+	{"pages", []string{"page", "p"}, pagesDir, readPageFile, listPages, pagePath, "page", nil},
+	{"quizzes", []string{"quiz", "q"}, quizzesDir, readQuizFile, listQuizzes, quizPath, "quiz", nil},
+}
+
+// findComponentKind looks up a kind by the name or alias given on the command
+// line.
+func findComponentKind(name string) (componentKind, bool) {
+	for _, kind := range componentKinds {
+		if kind.name == name {
+			return kind, true
+		}
+		for _, alias := range kind.aliases {
+			if alias == name {
+				return kind, true
+			}
+		}
+	}
+	return componentKind{}, false
+}
+
+// pushKind pushes every local component of the kind, carrying on past the ones
+// that fail.
+func pushKind(client *CanvasClient, db *sql.DB, courses []*Course, kind componentKind) error {
+	components, err := kind.loadComponents()
+	if err != nil {
+		return err
+	}
+	failed := func(component Component, err error) {
+		recordFailure(fmt.Sprintf("push %s %s", component.ComponentType(), component.Slug()), err)
+	}
+
+	if kind.pushOrder != nil {
+		sort.SliceStable(components, func(i, j int) bool {
+			return kind.pushOrder(components[i], components[j])
+		})
+		for _, component := range components {
+			if err := component.Push(client, db, courses, os.Stdout); err != nil {
+				failed(component, err)
+			}
+		}
+		return nil
+	}
+	return runJobs(len(components), func(i int, out io.Writer) error {
+		return components[i].Push(client, db, courses, out)
+	}, func(i int, err error) error {
+		if err != nil {
+			failed(components[i], err)
+		}
+		return nil
+	})
+}
+
+// loadComponents reads every component of the given kind from its directory.
+// A missing directory just means there aren't any yet.
+func (kind componentKind) loadComponents() ([]Component, error) {
+	components := make([]Component, 0)
+	files, err := ioutil.ReadDir(kind.dir)
+	if os.IsNotExist(err) {
+		return components, nil
+	}
+	if err != nil {
+		return components, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !isComponentFile(f.Name()) || strings.HasSuffix(f.Name(), quizQuestionsSuffix+".md") {
+			continue
+		}
+		component, err := kind.load(fmt.Sprintf("%s/%s", kind.dir, f.Name()))
+		if err != nil {
+			return components, fmt.Errorf("failed to load %s: %v", f.Name(), err)
+		}
+		components = append(components, component)
+	}
+	return components, nil
+}
+
+// findComponentCanvasId returns the mapping for the component in the given
+// course, or nil if the component hasn't been pulled from or pushed to that
+// course yet.
+func findComponentCanvasId(db *sql.DB, componentType, componentId string, course *Course) (*ComponentCanvasId, error) {
+	mapping := new(ComponentCanvasId)
+	err := meddler.QueryRow(db, mapping, "SELECT * FROM "+componentCanvasIdsTable+
+		" WHERE component_type = ? AND component_id = ? AND course_id = ?",
+		componentType, componentId, course.Id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return mapping, err
+}
+
+// findComponentId returns the local id of the component the given course knows
+// by canvasId, or "" if nothing with that id has been pulled from or pushed to
+// that course.
+func findComponentId(db *sql.DB, componentType string, canvasId int, course *Course) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT component_id FROM "+componentCanvasIdsTable+
+		" WHERE component_type = ? AND canvas_id = ? AND course_id = ?",
+		componentType, canvasId, course.Id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// findCanvasId returns the id the given course uses for the component, or 0
+// if the component hasn't been pulled from or pushed to that course yet.
+func findCanvasId(db *sql.DB, componentType, componentId string, course *Course) (int, error) {
+	mapping, err := findComponentCanvasId(db, componentType, componentId, course)
+	if mapping == nil || err != nil {
+		return 0, err
+	}
+	return mapping.CanvasId, nil
+}
+
+// saveCanvasId records (or updates) the id the given course uses for the
+// component.
+func saveCanvasId(db *sql.DB, componentType, componentId string, course *Course, canvasId int) error {
+	mapping, err := findComponentCanvasId(db, componentType, componentId, course)
+	if err != nil {
+		return err
+	}
+	if mapping == nil {
+		mapping = &ComponentCanvasId{ComponentType: componentType, ComponentId: componentId, CourseId: course.Id}
+	}
+	mapping.CanvasId = canvasId
+	return meddler.Save(db, componentCanvasIdsTable, mapping)
+}
+
+// saveSyncState records the id and the state of both sides of a component that
+// was just synced with the given course.
+func saveSyncState(db *sql.DB, componentType, componentId string, course *Course, canvasId int, updatedAt, remoteHash, contentHash string) error {
+	mapping, err := findComponentCanvasId(db, componentType, componentId, course)
+	if err != nil {
+		return err
+	}
+	if mapping == nil {
+		mapping = &ComponentCanvasId{ComponentType: componentType, ComponentId: componentId, CourseId: course.Id}
+	}
+	mapping.CanvasId = canvasId
+	mapping.UpdatedAt = updatedAt
+	mapping.RemoteHash = remoteHash
+	mapping.ContentHash = contentHash
+	return meddler.Save(db, componentCanvasIdsTable, mapping)
+}
+
+// trackComponent records the Canvas id of a component that was just listed
+// in the given course.
+func trackComponent(db *sql.DB, course *Course, component Component) error {
+	if component.GetCanvasId() == 0 {
+		return nil
+	}
+	return saveCanvasId(db, component.ComponentType(), component.Slug(), course, component.GetCanvasId())
+}
+
+// recordSync records the state of a component right after it was pulled from or
+// pushed to a course. local is the component as it is stored locally and
+// version is what Canvas has. The local side is recorded as the synced version
+// of its files, which may not be what's in them if a pull kept local changes.
+func recordSync(db *sql.DB, local Component, version courseVersion) error {
+	contentHash, err := hashFileBases(db, componentFiles(local)...)
+	if err != nil {
+		return err
+	}
+	return saveSyncState(db, local.ComponentType(), local.Slug(), version.course, version.component.GetCanvasId(),
+		version.updatedAt, version.remoteHash, contentHash)
+}
+
+// updateOrCreate updates the component in the course if it has an id there,
+// and creates it otherwise. A recorded id can outlive the component: if Canvas
+// no longer has it, the id is forgotten and the component is looked for again,
+// so it's updated wherever it's found or created anew. Returns the id that was
+// updated, or 0 if the component was created.
+func updateOrCreate(client *CanvasClient, db *sql.DB, course *Course, component Component, canvasId int, out io.Writer,
+	update func(canvasId int) error, create func() error) (int, error) {
+	if canvasId == 0 {
+		return 0, create()
+	}
+	err := update(canvasId)
+	if !isNotFound(err) {
+		return canvasId, err
+	}
+
+	fmt.Fprintf(out, "  %s %s is gone from %s, so looking for it again\n", component.ComponentType(), component.Slug(), course.Name)
+	mapping, err := findComponentCanvasId(db, component.ComponentType(), component.Slug(), course)
+	if err != nil {
+		return 0, err
+	}
+	if mapping != nil {
+		if err := forgetComponent(db, course, mapping); err != nil {
+			return 0, err
+		}
+	}
+	canvasId = 0
+	if finder, ok := component.(canvasIdFinder); ok {
+		if canvasId, err = finder.findCanvasId(client, db, course); err != nil {
+			return 0, err
+		}
+	}
+	if canvasId == 0 {
+		return 0, create()
+	}
+	return canvasId, update(canvasId)
+}
+
+// recordPush records a component that was just pushed to the given course: its
+// files are now the synced versions and Canvas's response is the remote state.
+// Nothing was actually pushed in a dry run, so nothing is recorded.
+func recordPush(client *CanvasClient, db *sql.DB, course *Course, local Component, pushed Component) error {
+	if client.DryRun {
+		return nil
+	}
+	updatedAt, remoteHash, err := remoteState(client, course, pushed)
+	if err != nil {
+		return err
+	}
+	if err := saveFileBases(db, componentFiles(local)...); err != nil {
+		return err
+	}
+	return recordSync(db, local, courseVersion{course, pushed, updatedAt, remoteHash})
+}
+
+// componentFiles lists the local files the component is stored in.
+func componentFiles(component Component) []string {
+	files := []string{component.Filepath()}
+	if quiz, ok := component.(*Quiz); ok {
+		files = append(files, quiz.questionsFilepath())
+	}
+	return files
+}
+
+// hashFiles hashes the contents of the given files together. Files that don't
+// exist are skipped.
+func hashFiles(paths ...string) (string, error) {
+	hash := sha1.New()
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashString(text string) string {
+	hash := sha1.Sum([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+// remoteState returns the updated_at timestamp Canvas reports for the object
+// (if it has one) and a hash of its fields, along with any parts it has in the
+// given course. Not every object has a timestamp, so the hash is what tells us
+// whether those have changed.
+func remoteState(client *CanvasClient, course *Course, remote interface{}) (string, string, error) {
+	fields, err := jsonFields(remote)
+	if err != nil {
+		return "", "", err
+	}
+	updatedAt, _ := fields["updated_at"].(string)
+
+	if p, ok := remote.(partsLister); ok {
+		parts, err := p.listParts(client, course)
+		if err != nil {
+			return "", "", err
+		}
+		raw, err := json.Marshal(parts)
+		if err != nil {
+			return "", "", err
+		}
+		var partFields interface{}
+		if err := json.Unmarshal(raw, &partFields); err != nil {
+			return "", "", err
+		}
+		fields["parts"] = partFields
+	}
+
+	fields = stripSectionSpecificFields(fields).(map[string]interface{})
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return "", "", err
+	}
+	return updatedAt, hashString(string(raw)), nil
+}
+
+// Fields that Canvas sets independently in each course, so they are expected
+// to differ between sections and aren't worth reporting.
+var sectionSpecificFields = map[string]bool{
+	"id":                       true,
+	"page_id":                  true,
+	"course_id":                true,
+	"created_at":               true,
+	"updated_at":               true,
+	"html_url":                 true,
+	"url":                      true,
+	"items_url":                true,
+	"preview_url":              true,
+	"submissions_download_url": true,
+	"needs_grading_count":      true,
+	"assignment_group_id":      true,
+	"quiz_id":                  true,
+	"discussion_topic":         true,
+	"module_id":                true,
+	"content_id":               true,
+	"prerequisite_module_ids":  true,
+	"never_drop":               true,
+	"assignment_id":            true,
+	"group_category_id":        true,
+}
+
+// Links inside html bodies point at the course they are in, e.g.,
+// /courses/615446/assignments/7701035, so the ids are masked before comparing
+var sectionSpecificLink = regexp.MustCompile(`/(courses|assignments|quizzes|modules|discussion_topics|files)/\d+`)
+
+// The version of a component pulled from a single course
+type courseVersion struct {
+	course    *Course
+	component Component
+	// its state in Canvas, as returned by remoteState
+	updatedAt  string
+	remoteHash string
+}
+
+// componentPathId returns what identifies the component in the given course's
+// api paths. Pages are addressed by their url, which is the same in every
+// course. Everything else is addressed by the id recorded for that course. If
+// nothing has been recorded, we fall back on the component's own id for the
+// first course, since that's most likely the course it was pulled from. Returns
+// nil if the component can't be found in the course.
+func componentPathId(db *sql.DB, course *Course, primary bool, component Component) (interface{}, error) {
+	if page, ok := component.(*Page); ok {
+		return page.Url, nil
+	}
+	canvasId, err := findCanvasId(db, component.ComponentType(), component.Slug(), course)
+	if err != nil {
+		return nil, err
+	}
+	if canvasId == 0 && primary {
+		canvasId = component.GetCanvasId()
+	}
+	if canvasId == 0 {
+		return nil, nil
+	}
+	return canvasId, nil
+}
+
+// pullComponent pulls the component from each of the given courses, records its
+// id in each one, and reports any differences between the courses. The version
+// from the first course that has it is the one that gets dumped locally.
+func pullComponent(client *CanvasClient, db *sql.DB, courses []*Course, path string, component Component) error {
+	versions, err := fetchComponent(client, db, courses, path, component, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return saveComponent(db, courses, component, versions)
+}
+
+// fetchComponent gets the component from each of the given courses. This is the
+// part of a pull that talks to Canvas, so it's safe to run alongside other
+// fetches; nothing local is written.
+func fetchComponent(client *CanvasClient, db *sql.DB, courses []*Course, path string, component Component, out io.Writer) ([]courseVersion, error) {
+	versions := make([]courseVersion, 0, len(courses))
+	for i, course := range courses {
+		id, err := componentPathId(db, course, i == 0, component)
+		if err != nil {
+			return versions, err
+		}
+		if id == nil {
+			continue
+		}
+		fullPath := fmt.Sprintf(path, course.CanvasId, id)
+
+		fmt.Fprintf(out, "Pulling %T %s\n", component, fullPath)
+		pulled := reflect.New(reflect.TypeOf(component).Elem()).Interface().(Component)
+		found, err := client.findObject(fullPath, url.Values{}, pulled)
+		if err != nil {
+			return versions, fmt.Errorf("failed to pull from %s: %v", course.Name, err)
+		}
+		if !found {
+			continue
+		}
+		updatedAt, remoteHash, err := remoteState(client, course, pulled)
+		if err != nil {
+			return versions, fmt.Errorf("failed to pull from %s: %v", course.Name, err)
+		}
+		versions = append(versions, courseVersion{course, pulled, updatedAt, remoteHash})
+	}
+
+	if len(versions) == 0 {
+		return versions, fmt.Errorf("%s %s was not found in any course", component.ComponentType(), component.Slug())
+	}
+	if p, ok := versions[0].component.(partsPuller); ok {
+		if err := p.pullParts(client, db, versions[0].course); err != nil {
+			return versions, err
+		}
+	}
+	return versions, nil
+}
+
+// saveComponent reports any differences between the versions fetched from each
+// course, dumps the first one locally, and records its id and sync state in
+// each course. They're only recorded once the dump succeeds, so an aborted pull
+// leaves the sync state as it was.
+func saveComponent(db *sql.DB, courses []*Course, component Component, versions []courseVersion) error {
+	reportDifferences(component.ComponentType(), component.Slug(), courses, versions)
+
+	localId := component.Slug()
+	reflect.ValueOf(component).Elem().Set(reflect.ValueOf(versions[0].component).Elem())
+	if err := component.Dump(db); err != nil {
+		return err
+	}
+	for _, version := range versions {
+		// record it under the local identity even if it was renamed in Canvas
+		err := saveCanvasId(db, component.ComponentType(), localId, version.course, version.component.GetCanvasId())
+		if err != nil {
+			return err
+		}
+		if err := recordSync(db, component, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullComponents lists the components of a single type in each course,
+// records their ids, and then pulls each distinct component. Components that
+// fail are recorded and the rest are still pulled. Listing and fetching run
+// as concurrent jobs, while everything written locally happens in order.
+func pullComponents(client *CanvasClient, db *sql.DB, courses []*Course, list func(*CanvasClient, *Course) ([]Component, error), path string) error {
+	listed := make([][]Component, len(courses))
+	seen := make(map[string]bool)
+	components := make([]Component, 0)
+	err := runJobs(len(courses), func(i int, out io.Writer) error {
+		var err error
+		listed[i], err = list(client, courses[i])
+		return err
+	}, func(i int, err error) error {
+		if err != nil {
+			recordFailure("list components in "+courses[i].Name, err)
+			return nil
+		}
+		for _, component := range listed[i] {
+			if err := trackComponent(db, courses[i], component); err != nil {
+				return err
+			}
+			if !seen[component.Slug()] {
+				seen[component.Slug()] = true
+				components = append(components, component)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	versions := make([][]courseVersion, len(components))
+	return runJobs(len(components), func(i int, out io.Writer) error {
+		var err error
+		versions[i], err = fetchComponent(client, db, courses, path, components[i], out)
+		return err
+	}, func(i int, err error) error {
+		component := components[i]
+		if err == nil {
+			err = saveComponent(db, courses, component, versions[i])
+		}
+		if err == errPullAborted {
+			return err
+		}
+		if err != nil {
+			recordFailure(fmt.Sprintf("pull %s %s", component.ComponentType(), component.Slug()), err)
+		}
+		return nil
+	})
+}
+
+// jsonFields flattens the object into its json fields.
+func jsonFields(object interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// componentFields flattens the component into its json fields, minus the ones
+// that are expected to differ between courses.
+func componentFields(component interface{}) (map[string]interface{}, error) {
+	fields, err := jsonFields(component)
+	if err != nil {
+		return nil, err
+	}
+	return stripSectionSpecificFields(fields).(map[string]interface{}), nil
+}
+
+func stripSectionSpecificFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if sectionSpecificFields[key] {
+				delete(v, key)
+			} else {
+				v[key] = stripSectionSpecificFields(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = stripSectionSpecificFields(v[i])
+		}
+	case string:
+		return sectionSpecificLink.ReplaceAllString(v, "/$1/:id")
+	}
+	return value
+}
+
+// componentDifferences lists the fields that differ between two versions of a
+// component, ignoring fields that are always section specific.
+func componentDifferences(a, b interface{}) ([]string, error) {
+	aFields, err := componentFields(a)
+	if err != nil {
+		return nil, err
+	}
+	bFields, err := componentFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	differences := make([]string, 0)
+	for key, value := range aFields {
+		if !reflect.DeepEqual(value, bFields[key]) {
+			differences = append(differences, key)
+		}
+	}
+	for key := range bFields {
+		if _, ok := aFields[key]; !ok {
+			differences = append(differences, key)
+		}
+	}
+	sort.Strings(differences)
+	return differences, nil
 }
 
-func pullComponent(db *sql.DB, path string, id interface{}, component Component) error {
-	courses, _ := findCourses(db)
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	fullPath := fmt.Sprintf(path, courseId, id)
+// reportDifferences prints which courses are missing the component and which
+// courses have a version that differs from the first course's.
+func reportDifferences(componentType, componentId string, courses []*Course, versions []courseVersion) {
+	found := make(map[int]bool)
+	for _, version := range versions {
+		found[version.course.Id] = true
+	}
+	for _, course := range courses {
+		if !found[course.Id] {
+			fmt.Printf("  %s %s is missing from %s\n", componentType, componentId, course.Name)
+		}
+	}
 
-	fmt.Printf("Pulling %T %s\n", component, fullPath)
-	mustGetObject(fullPath, url.Values{}, component)
-	return component.Dump()
+	primary := versions[0]
+	for _, version := range versions[1:] {
+		differences, err := componentDifferences(primary.component, version.component)
+		if err != nil {
+			fmt.Printf("  unable to compare %s %s in %s: %v\n", componentType, componentId, version.course.Name, err)
+			continue
+		}
+		if len(differences) > 0 {
+			fmt.Printf("  %s %s differs between %s and %s: %s\n", componentType, componentId,
+				primary.course.Name, version.course.Name, strings.Join(differences, ", "))
+		}
+	}
 }
 
 func slug(text string) string {
@@ -2,21 +2,23 @@ package main
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 
-	"github.com/russross/blackfriday"
 	"github.com/russross/meddler"
 )
 
 const (
 	coursesTable = "courses"
+	syllabusFile = "syllabus.md"
+	// the syllabus is tracked like a component with a single instance
+	syllabusComponentType = "syllabus"
+	syllabusComponentId   = "syllabus"
 )
 
 type Course struct {
@@ -32,22 +34,6 @@ type Course struct {
 	WorkflowState string `json:"workflow_state" yaml:"workflow_state" meddler:"workflow_state"`
 }
 
-func mustCreateCoursesTable(db *sql.DB) {
-	command := `CREATE TABLE courses (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		"canvas_id" integer NOT NULL,
-		"name" TEXT NOT NULL,
-		"code" TEXT NOT NULL,
-		"workflow_state" TEXT NOT NULL
-	  );`
-
-	statement, err := db.Prepare(command)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	statement.Exec()
-}
-
 func findCourse(db *sql.DB, courseId int) (*Course, error) {
 	course := new(Course)
 	err := meddler.QueryRow(db, course, "select * from "+coursesTable+" where canvas_id = ?", courseId)
@@ -60,6 +46,39 @@ func findCourses(db *sql.DB) ([]*Course, error) {
 	return courses, err
 }
 
+// selectCourses finds the courses picked out by the given selectors, or all
+// courses if there are none. Each selector is resolved with matchCourse and must
+// match exactly one course, so a push never lands in a section by accident.
+func selectCourses(db *sql.DB, selectors []string) ([]*Course, error) {
+	if len(selectors) == 0 {
+		return findCourses(db)
+	}
+
+	selected := []*Course{}
+	seen := make(map[int]bool)
+	for _, selector := range selectors {
+		courses, err := matchCourse(db, selector)
+		if err != nil {
+			return selected, err
+		}
+		if len(courses) == 0 {
+			return selected, fmt.Errorf("no course matches %q", selector)
+		}
+		if len(courses) > 1 {
+			names := make([]string, 0, len(courses))
+			for _, course := range courses {
+				names = append(names, fmt.Sprintf("%d (%s)", course.CanvasId, course.Name))
+			}
+			return selected, fmt.Errorf("%q matches more than one course: %s", selector, strings.Join(names, ", "))
+		}
+		if !seen[courses[0].Id] {
+			seen[courses[0].Id] = true
+			selected = append(selected, courses[0])
+		}
+	}
+	return selected, nil
+}
+
 func getCourseIdFromUrl(courseUrl string) (int, error) {
 	parsed, err := url.Parse(courseUrl)
 	if err != nil {
@@ -95,51 +114,96 @@ func matchCourse(db *sql.DB, search string) ([]*Course, error) {
 	return courses, err
 }
 
-func pullCourse(db *sql.DB, courseId int) (*Course, error) {
+func getCourse(client *CanvasClient, courseId int) (*Course, error) {
 	course := new(Course)
 	values := url.Values{}
 	values.Add("include[]", "syllabus_body")
-	if !getObject(fmt.Sprintf(coursePath, courseId), values, course) {
-		return course, errors.New("Failed to pull course from Canvas")
-	}
-
-	// TODO: prompt for overwrite, manually merge/update, abort
-
-	err := course.Dump()
+	err := client.getObject(fmt.Sprintf(coursePath, courseId), values, course)
 	return course, err
 }
 
-func pullCourses(db *sql.DB) ([]*Course, error) {
-	courses, err := findCourses(db)
+// pullCourse fetches a course that is being added. Its syllabus is only
+// written if there isn't one yet, since the local syllabus already belongs to
+// the courses added before it.
+func pullCourse(client *CanvasClient, db *sql.DB, courseId int) (*Course, error) {
+	course, err := getCourse(client, courseId)
+	if err != nil {
+		return course, err
+	}
+
+	contents, err := ioutil.ReadFile(syllabusFile)
+	if os.IsNotExist(err) {
+		return course, course.Dump(db)
+	}
 	if err != nil {
-		return courses, err
+		return course, err
+	}
+	_, body := splitFile(string(contents))
+	if !isHtmlBody(body) {
+		body = renderMarkdown(body)
 	}
+	if !sameHtml(body, course.Syllabus) {
+		fmt.Printf("  keeping the local syllabus, which differs from %s's\n", course.Name)
+	}
+	return course, nil
+}
 
-	for i := range courses {
-		courses[i], err = pullCourse(db, courses[i].Id)
+func pullCourses(client *CanvasClient, db *sql.DB, courses []*Course) ([]*Course, error) {
+	pulled := make([]*Course, 0, len(courses))
+	for _, course := range courses {
+		fmt.Printf("Pulling %s\n", course.Name)
+		p, err := getCourse(client, course.CanvasId)
 		if err != nil {
-			return courses, err
+			return pulled, err
 		}
+		p.Id = course.Id
+		pulled = append(pulled, p)
+	}
+	if len(pulled) == 0 {
+		return pulled, nil
 	}
 
-	return courses, nil
-}
-
-func pushCourses(db *sql.DB) {
-	courses, err := findCourses(db)
-	if err != nil {
-		log.Fatalf("Error finding courses: %v", err)
+	// only the first course's syllabus gets written, so report any others
+	// that don't match it
+	if err := pulled[0].Dump(db); err != nil {
+		return pulled, err
 	}
-	for _, course := range courses {
-		course.Push()
+	for _, course := range pulled {
+		if err := course.recordSyllabusSync(db, course.Syllabus); err != nil {
+			return pulled, err
+		}
+	}
+	for i := 1; i < len(pulled); i++ {
+		course := pulled[i]
+		differences, err := componentDifferences(pulled[0], course)
+		if err != nil {
+			return pulled, err
+		}
+		for _, field := range differences {
+			if field == "syllabus_body" {
+				fmt.Printf("  syllabus differs between %s and %s\n", pulled[0].Name, course.Name)
+			}
+		}
 	}
+
+	return pulled, nil
 }
 
-func (course *Course) Dump() error {
-	if _, err := os.Stat("syllabus.md"); os.IsNotExist(err) {
-		return writeFile("syllabus.md", "", course.Syllabus)
-	}
-	return nil
+// pushCourses pushes the syllabus to each course, carrying on past the ones
+// that fail.
+func pushCourses(client *CanvasClient, db *sql.DB, courses []*Course) {
+	runJobs(len(courses), func(i int, out io.Writer) error {
+		return courses[i].Push(client, db, out)
+	}, func(i int, err error) error {
+		if err != nil {
+			recordFailure("push syllabus to "+courses[i].Name, err)
+		}
+		return nil
+	})
+}
+
+func (course *Course) Dump(db *sql.DB) error {
+	return writeFile(db, syllabusFile, "", course.Syllabus)
 }
 
 func (course *Course) GetCourseNumber() string {
@@ -147,12 +211,12 @@ func (course *Course) GetCourseNumber() string {
 	return values[0]
 }
 
-func (course *Course) Push() error {
-	syllabusmd, err := ioutil.ReadFile("syllabus.md")
+func (course *Course) Push(client *CanvasClient, db *sql.DB, out io.Writer) error {
+	syllabusmd, err := ioutil.ReadFile(syllabusFile)
 	if err != nil {
 		return err
 	}
-	syllabushtml := string(blackfriday.MarkdownCommon(syllabusmd))
+	syllabushtml := renderMarkdown(string(syllabusmd))
 	c := map[string]interface{}{
 		"course": map[string]interface{}{
 			"name":          course.Name,
@@ -160,13 +224,39 @@ func (course *Course) Push() error {
 		},
 	}
 	courseFullPath := fmt.Sprintf(coursePath, course.CanvasId)
-	fmt.Printf("Pushing %s\n", course.Name)
-	mustPutObject(courseFullPath, url.Values{}, c, nil)
-	return nil
+	fmt.Fprintf(out, "Pushing %s\n", course.Name)
+	pushed := new(Course)
+	if err := client.putObject(courseFullPath, url.Values{}, c, pushed); err != nil {
+		return err
+	}
+	if client.DryRun {
+		return nil
+	}
+	if pushed.Syllabus == "" {
+		pushed.Syllabus = syllabushtml
+	}
+	if err := saveFileBases(db, syllabusFile); err != nil {
+		return err
+	}
+	return course.recordSyllabusSync(db, pushed.Syllabus)
+}
+
+// recordSyllabusSync records the state of the syllabus right after it was
+// synced with this course.
+func (course *Course) recordSyllabusSync(db *sql.DB, syllabus string) error {
+	contentHash, err := hashFileBases(db, syllabusFile)
+	if err != nil {
+		return err
+	}
+	return saveSyncState(db, syllabusComponentType, syllabusComponentId, course, course.CanvasId, "", hashString(syllabus), contentHash)
 }
 
 func (course *Course) Remove(db *sql.DB) error {
-	_, err := db.Exec("DELETE from "+coursesTable+" WHERE id = ?", course.Id)
+	_, err := db.Exec("DELETE from "+componentCanvasIdsTable+" WHERE course_id = ?", course.Id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE from "+coursesTable+" WHERE id = ?", course.Id)
 	return err
 }
 
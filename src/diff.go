@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	diffContext = 3 // lines of context around each change
+)
+
+// A single line of a diff: ' ' for unchanged, '-' for removed, '+' for added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines finds the shortest edit script from a to b using the longest common
+// subsequence of lines.
+func diffLines(a, b []string) []diffLine {
+	// common prefixes and suffixes are the bulk of most diffs, so trim them
+	// before building the table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	aMid, bMid := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the lcs of aMid[i:] and bMid[j:]
+	lcs := make([][]int32, len(aMid)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bMid)+1)
+	}
+	for i := len(aMid) - 1; i >= 0; i-- {
+		for j := len(bMid) - 1; j >= 0; j-- {
+			if aMid[i] == bMid[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(aMid) || j < len(bMid) {
+		switch {
+		case i < len(aMid) && j < len(bMid) && aMid[i] == bMid[j]:
+			lines = append(lines, diffLine{' ', aMid[i]})
+			i++
+			j++
+		case j == len(bMid) || (i < len(aMid) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', aMid[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', bMid[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines
+}
+
+// unifiedDiff renders the differences between two texts in unified diff
+// format. Returns an empty string if they are the same.
+func unifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	// the line number in each text that each diff line starts at
+	fromLine := make([]int, len(lines)+1)
+	toLine := make([]int, len(lines)+1)
+	for i, line := range lines {
+		fromLine[i+1], toLine[i+1] = fromLine[i], toLine[i]
+		if line.op != '+' {
+			fromLine[i+1]++
+		}
+		if line.op != '-' {
+			toLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	i := 0
+	for i < len(lines) {
+		for i < len(lines) && lines[i].op == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		// grow the hunk until the unchanged run after it is too long to join
+		// it to the next change
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].op == ' ' {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end += diffContext
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = run
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(fromLine[start], fromLine[end]-fromLine[start]),
+			hunkRange(toLine[start], toLine[end]-toLine[start]))
+		for _, line := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.op, line.text)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range refers to the line before it
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// stripSectionSpecificYaml removes the fields Canvas sets independently in each
+// course from yaml metadata, keeping everything else in order.
+func stripSectionSpecificYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		stripped := make(yaml.MapSlice, 0, len(v))
+		for _, item := range v {
+			if key, ok := item.Key.(string); ok && sectionSpecificFields[key] {
+				continue
+			}
+			stripped = append(stripped, yaml.MapItem{Key: item.Key, Value: stripSectionSpecificYaml(item.Value)})
+		}
+		return stripped
+	case []interface{}:
+		for i := range v {
+			v[i] = stripSectionSpecificYaml(v[i])
+		}
+	}
+	return value
+}
+
+// renderComponent renders a component the way it looks once it's in Canvas: its
+// yaml metadata (minus the fields Canvas sets per course) followed by its html
+// body. Local bodies are markdown, so they go through the same rendering as a
+// push.
+func renderComponent(component Component, local bool) (string, error) {
+	raw, err := yaml.Marshal(component)
+	if err != nil {
+		return "", err
+	}
+	var metadata yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &metadata); err != nil {
+		return "", err
+	}
+	raw, err = yaml.Marshal(stripSectionSpecificYaml(metadata))
+	if err != nil {
+		return "", err
+	}
+
+	text := string(raw)
+	if c, ok := component.(bodyComponent); ok {
+		body := c.htmlBody()
+		if local {
+			body = renderMarkdown(body)
+		}
+		text = fmt.Sprintf("```\n%s```\n%s", text, body)
+	}
+	return text, nil
+}
+
+// diffComponent diffs what's currently in the course against what pushing the
+// local component would send.
+func diffComponent(client *CanvasClient, db *sql.DB, course *Course, primary bool, kind componentKind, local Component) (string, error) {
+	remoteText := ""
+	id, err := componentPathId(db, course, primary, local)
+	if err != nil {
+		return "", err
+	}
+	if id != nil {
+		remote := reflect.New(reflect.TypeOf(local).Elem()).Interface().(Component)
+		found, err := client.findObject(fmt.Sprintf(kind.path, course.CanvasId, id), url.Values{}, remote)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			// parts that are only pulled separately, like module items or the
+			// name of an assignment's group, are part of what's in the file
+			if p, ok := remote.(partsPuller); ok {
+				if err := p.pullParts(client, db, course); err != nil {
+					return "", err
+				}
+			}
+			remoteText, err = renderComponent(remote, false)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	localText, err := renderComponent(local, true)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(fmt.Sprintf("%s (%s)", local.Filepath(), course.Name), local.Filepath(), remoteText, localText), nil
+}
+
+// diffSyllabus diffs the course's syllabus against the rendered local one.
+func diffSyllabus(client *CanvasClient, course *Course) (string, error) {
+	remote, err := getCourse(client, course.CanvasId)
+	if err != nil {
+		return "", err
+	}
+	syllabusmd, err := ioutil.ReadFile(syllabusFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	local := ""
+	if err == nil {
+		local = renderMarkdown(string(syllabusmd))
+	}
+	return unifiedDiff(fmt.Sprintf("%s (%s)", syllabusFile, course.Name), syllabusFile, remote.Syllabus, local), nil
+}
+
+// diffComponents prints the diff of each component in each course. Components
+// that can't be diffed are recorded and skipped.
+func diffComponents(client *CanvasClient, db *sql.DB, courses []*Course, kind componentKind, components []Component) {
+	for _, component := range components {
+		for i, course := range courses {
+			diff, err := diffComponent(client, db, course, i == 0, kind, component)
+			if err != nil {
+				recordFailure(fmt.Sprintf("diff %s %s in %s", component.ComponentType(), component.Slug(), course.Name), err)
+				continue
+			}
+			fmt.Print(diff)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	discussionsDir = "discussions" // TODO: make configable
+)
+
+type DiscussionTopic struct {
+	Id       int    `json:"-" yaml:"-" meddler:"id,pk"`
+	CanvasId int    `json:"id" yaml:"id" meddler:"canvas_id"`
+	Title    string `json:"title" yaml:"title" meddler:"title"`
+	Message  string `json:"message" yaml:"-" meddler:"message"`          // the HTML content of the message body
+	HtmlUrl  string `json:"html_url" yaml:"html_url" meddler:"html_url"` // the URL to the discussion topic in Canvas
+
+	// the type of discussion: 'side_comment' for discussions that only allow
+	// one level of nested comments, or 'threaded' for fully threaded
+	// discussions
+	DiscussionType string `json:"discussion_type" yaml:"discussion_type" meddler:"discussion_type"`
+
+	Published          bool   `json:"published" yaml:"published" meddler:"published"`                                  // whether this discussion topic is published (true) or draft state (false)
+	Pinned             bool   `json:"pinned" yaml:"pinned" meddler:"pinned"`                                           // whether this discussion topic is pinned to the top of the list
+	DelayedPostAt      string `json:"delayed_post_at" yaml:"delayed_post_at" meddler:"delayed_post_at"`                // the datetime to publish the topic (if not right away)
+	LockAt             string `json:"lock_at" yaml:"lock_at" meddler:"lock_at"`                                        // the datetime to lock the topic (if ever)
+	RequireInitialPost bool   `json:"require_initial_post" yaml:"require_initial_post" meddler:"require_initial_post"` // whether students must post before they can see replies
+	PodcastEnabled     bool   `json:"podcast_enabled" yaml:"podcast_enabled" meddler:"podcast_enabled"`                // whether or not this is a podcast feed
+	AllowRating        bool   `json:"allow_rating" yaml:"allow_rating" meddler:"allow_rating"`                         // whether or not users can rate entries in this topic
+	OnlyGradersCanRate bool   `json:"only_graders_can_rate" yaml:"only_graders_can_rate" meddler:"only_graders_can_rate"`
+	SortByRating       bool   `json:"sort_by_rating" yaml:"sort_by_rating" meddler:"sort_by_rating"`
+
+	// The id of the group set the discussion is split up by, if it's a group
+	// discussion.
+	GroupCategoryId int `json:"group_category_id" yaml:"group_category_id" meddler:"group_category_id"`
+	// The name of the group set, which is what gets pushed since the ids differ
+	// in every course. Group sets aren't managed by easel, so each course needs
+	// one by this name.
+	GroupCategory string `json:"-" yaml:"group_category,omitempty" meddler:"-"`
+
+	// the id of the assignment behind the discussion, if it's graded
+	AssignmentId int `json:"assignment_id" yaml:"assignment_id" meddler:"assignment_id"`
+	// The grading settings of a graded discussion. A discussion without these
+	// isn't graded.
+	Assignment *DiscussionAssignment `json:"-" yaml:"assignment,omitempty" meddler:"-"`
+}
+
+// DiscussionAssignment holds the settings of the assignment Canvas keeps
+// behind a graded discussion.
+type DiscussionAssignment struct {
+	PointsPossible    float64 `json:"points_possible" yaml:"points_possible"`
+	GradingType       string  `json:"grading_type" yaml:"grading_type"` // one of 'pass_fail', 'percent', 'letter_grade', 'gpa_scale', 'points'
+	DueAt             string  `json:"due_at" yaml:"due_at"`
+	UnlockAt          string  `json:"unlock_at" yaml:"unlock_at"`
+	LockAt            string  `json:"lock_at" yaml:"lock_at"`
+	AssignmentGroupId int     `json:"assignment_group_id" yaml:"-"`
+	// the local name of the assignment's group, which is what gets pushed
+	AssignmentGroup string `json:"-" yaml:"assignment_group,omitempty"`
+}
+
+// A group set, which Canvas calls a group category
+type GroupCategory struct {
+	CanvasId int    `json:"id"`
+	Name     string `json:"name"`
+}
+
+func getDiscussionTopics(client *CanvasClient, course *Course) ([]*DiscussionTopic, error) {
+	topics := make([]*DiscussionTopic, 0)
+	values := url.Values{}
+	values.Add("per_page", "100")
+	reqUrl := fmt.Sprintf(discussionTopicsPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &topics)
+	return topics, err
+}
+
+func readDiscussionFile(filepath string) (Component, error) {
+	topic := new(DiscussionTopic)
+	message, err := readFile(filepath, topic)
+	topic.Message = message
+	return topic, err
+}
+
+func listDiscussionTopics(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	topics, err := getDiscussionTopics(client, course)
+	for _, topic := range topics {
+		components = append(components, topic)
+	}
+	return components, err
+}
+
+func pullDiscussionTopics(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listDiscussionTopics, discussionTopicPath)
+}
+
+func pushDiscussionTopic(client *CanvasClient, db *sql.DB, courses []*Course, filepath string, out io.Writer) error {
+	topic, err := readDiscussionFile(filepath)
+	if err != nil {
+		return err
+	}
+	return topic.(*DiscussionTopic).Push(client, db, courses, out)
+}
+
+// findGroupCategoryId finds the id of the group set with the given name in a
+// course.
+func findGroupCategoryId(client *CanvasClient, course *Course, name string) (int, error) {
+	values := url.Values{}
+	values.Add("per_page", "100")
+	categories := make([]*GroupCategory, 0)
+	if err := client.getList(fmt.Sprintf(groupCategoriesPath, course.CanvasId), values, &categories); err != nil {
+		return 0, err
+	}
+	for _, category := range categories {
+		if category.Name == name {
+			return category.CanvasId, nil
+		}
+	}
+	return 0, fmt.Errorf("there is no group set named %q in %s; make one in Canvas first", name, course.Name)
+}
+
+func (topic *DiscussionTopic) ComponentType() string {
+	return "discussion"
+}
+
+func (topic *DiscussionTopic) Dump(db *sql.DB) error {
+	metadata, err := yaml.Marshal(topic)
+	if err != nil {
+		return err
+	}
+	return writeFile(db, topic.Filepath(), string(metadata), topic.Message)
+}
+
+func (topic *DiscussionTopic) htmlBody() string {
+	return topic.Message
+}
+
+func (topic *DiscussionTopic) Filepath() string {
+	return fmt.Sprintf("%s/%s.md", discussionsDir, topic.Slug())
+}
+
+func (topic *DiscussionTopic) GetCanvasId() int {
+	return topic.CanvasId
+}
+
+func (topic *DiscussionTopic) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, discussionTopicPath, topic)
+}
+
+// Gets the grading settings of a graded discussion and the name of a group
+// discussion's group set from the same course the discussion came from, so
+// they're dumped along with it.
+func (topic *DiscussionTopic) pullParts(client *CanvasClient, db *sql.DB, course *Course) error {
+	if topic.AssignmentId > 0 {
+		assignment := new(DiscussionAssignment)
+		if err := client.getObject(fmt.Sprintf(assignmentPath, course.CanvasId, topic.AssignmentId), url.Values{}, assignment); err != nil {
+			return err
+		}
+		if assignment.AssignmentGroupId > 0 {
+			name, err := assignmentGroupSlug(client, course, assignment.AssignmentGroupId)
+			if err != nil {
+				return err
+			}
+			assignment.AssignmentGroup = name
+		}
+		topic.Assignment = assignment
+	}
+	if topic.GroupCategoryId > 0 {
+		category := new(GroupCategory)
+		if err := client.getObject(fmt.Sprintf(groupCategoryPath, topic.GroupCategoryId), url.Values{}, category); err != nil {
+			return err
+		}
+		topic.GroupCategory = category.Name
+	}
+	return nil
+}
+
+// Finds the id of this discussion in the given course. Uses the id recorded in
+// the db if there is one, otherwise searches the course's discussions for one
+// with the same title. Returns 0 if the discussion doesn't exist in the course
+// yet.
+func (topic *DiscussionTopic) findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error) {
+	canvasId, err := findCanvasId(db, topic.ComponentType(), topic.Slug(), course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	values := url.Values{}
+	values.Add("per_page", "100")
+	values.Add("search_term", topic.Title)
+	p := client.newPager(fmt.Sprintf(discussionTopicsPath, course.CanvasId), values)
+	var candidates []*DiscussionTopic
+	for p.Next(&candidates) {
+		for _, candidate := range candidates {
+			if candidate.Title == topic.Title {
+				return candidate.CanvasId, nil
+			}
+		}
+	}
+	return 0, p.Err()
+}
+
+// Pushes the discussion to the given courses, updating it if it already exists
+// there and creating it otherwise. The group set and the assignment group of a
+// graded discussion are looked up in each course.
+func (topic *DiscussionTopic) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
+	for _, course := range courses {
+		canvasId, err := topic.findCanvasId(client, db, course)
+		if err != nil {
+			return err
+		}
+		t, err := topic.payload(client, db, course)
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+
+		pushed := new(DiscussionTopic)
+		_, err = updateOrCreate(client, db, course, topic, canvasId, out, func(canvasId int) error {
+			fmt.Fprintf(out, "Updating %s in %s\n", topic.Title, course.Name)
+			return client.putObject(fmt.Sprintf(discussionTopicPath, course.CanvasId, canvasId), url.Values{}, t, pushed)
+		}, func() error {
+			fmt.Fprintf(out, "Creating %s in %s\n", topic.Title, course.Name)
+			return client.postObject(fmt.Sprintf(discussionTopicsPath, course.CanvasId), url.Values{}, t, pushed)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+		if err := recordPush(client, db, course, topic, pushed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payload is the discussion in the form Canvas takes it, which isn't wrapped,
+// with its group set and assignment group looked up in the given course.
+func (topic *DiscussionTopic) payload(client *CanvasClient, db *sql.DB, course *Course) (map[string]interface{}, error) {
+	t := map[string]interface{}{
+		"title":                 topic.Title,
+		"message":               renderMarkdown(topic.Message),
+		"discussion_type":       topic.DiscussionType,
+		"published":             topic.Published,
+		"pinned":                topic.Pinned,
+		"delayed_post_at":       topic.DelayedPostAt,
+		"lock_at":               topic.LockAt,
+		"require_initial_post":  topic.RequireInitialPost,
+		"podcast_enabled":       topic.PodcastEnabled,
+		"allow_rating":          topic.AllowRating,
+		"only_graders_can_rate": topic.OnlyGradersCanRate,
+		"sort_by_rating":        topic.SortByRating,
+	}
+	if topic.GroupCategory != "" {
+		categoryId, err := findGroupCategoryId(client, course, topic.GroupCategory)
+		if err != nil {
+			return nil, err
+		}
+		t["group_category_id"] = categoryId
+	}
+	if a := topic.Assignment; a != nil {
+		assignment := map[string]interface{}{
+			"points_possible": a.PointsPossible,
+			"grading_type":    a.GradingType,
+			"due_at":          a.DueAt,
+			"unlock_at":       a.UnlockAt,
+			"lock_at":         a.LockAt,
+		}
+		if a.AssignmentGroup != "" {
+			groupId, err := findAssignmentGroupId(client, db, course, a.AssignmentGroup)
+			if err != nil {
+				return nil, err
+			}
+			assignment["assignment_group_id"] = groupId
+		}
+		t["assignment"] = assignment
+	}
+	return t, nil
+}
+
+func (topic *DiscussionTopic) Slug() string {
+	return slug(topic.Title)
+}
@@ -0,0 +1,1688 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// setupEasel starts each test the way an instructor starts out: logged in to
+// the fake Canvas, with a fresh easel directory that has the given courses
+// added. The test runs in that directory.
+func setupEasel(t *testing.T, fake *fakeCanvas, courseIds ...int) {
+	t.Setenv("HOME", t.TempDir())
+	// keep tokens out of the real keyring
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "")
+	t.Setenv(passphraseEnv, "test passphrase")
+	t.Setenv(tokenEnv, "")
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	Config.Host, Config.Token = "", ""
+	Config.profile, Config.profileInUse = "", ""
+	Config.useOAuth, Config.oauth = false, nil
+	Config.clientId, Config.clientSecret, Config.redirectPort = "", "", 0
+	Config.apiReport, Config.apiDump, Config.dryRun, Config.applyWeights = false, false, false, false
+	Config.prune, Config.yes, Config.force = false, false, false
+	Config.courses = nil
+	Config.record, Config.replay = "", ""
+	Config.jobs = 1
+	Config.retries, Config.maxBackoff = 0, defaultMaxBackoff
+	// a conflict would be a bug in these tests, so don't sit waiting on a prompt
+	Config.strategy = strategyAbort
+	failures = nil
+
+	CommandLogin(nil, []string{fake.server.URL, fakeToken})
+	CommandInit(nil, nil)
+	for _, id := range courseIds {
+		CommandCourseAdd(nil, []string{fmt.Sprintf("%s/courses/%d", fake.server.URL, id)})
+	}
+}
+
+// pushAll pushes every local component of the given kind without exiting on
+// failures the way the push command does.
+func pushAll(t *testing.T, db *sql.DB, courses []*Course, kindName string) error {
+	kind, ok := findComponentKind(kindName)
+	if !ok {
+		t.Fatalf("no component kind %s", kindName)
+	}
+	return pushKind(newClient(), db, courses, kind)
+}
+
+func openTestDb(t *testing.T) (*sql.DB, []*Course) {
+	db := findDb()
+	t.Cleanup(func() { db.Close() })
+	courses, err := findCourses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, courses
+}
+
+func readTestFile(t *testing.T, path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCourseAddPullsSyllabus(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "<p>Welcome</p>")
+	setupEasel(t, fake, 101)
+
+	_, courses := openTestDb(t)
+	if len(courses) != 1 || courses[0].CanvasId != 101 || courses[0].Name != "CS 1400-01 Fundamentals" {
+		t.Fatalf("expected course 101 to be added, got %v", courses)
+	}
+	if syllabus := readTestFile(t, syllabusFile); syllabus != "<p>Welcome</p>" {
+		t.Errorf("expected the syllabus from Canvas, got %q", syllabus)
+	}
+}
+
+func TestPullPagesFollowsPagination(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.pageSize = 2
+	for _, name := range []string{"Intro", "Variables", "Loops"} {
+		fake.add("/courses/101/pages", map[string]interface{}{
+			"url":   strings.ToLower(name),
+			"title": name,
+			"body":  "<p>" + name + "</p>",
+		})
+	}
+	setupEasel(t, fake, 101)
+
+	CommandPull(nil, []string{"pages"})
+
+	for _, name := range []string{"intro", "variables", "loops"} {
+		text := readTestFile(t, filepath.Join(pagesDir, name+".md"))
+		metadata, body := splitFile(text)
+		if !strings.Contains(metadata, "url: "+name) {
+			t.Errorf("expected metadata for %s, got %q", name, metadata)
+		}
+		if !strings.Contains(body, "</p>") {
+			t.Errorf("expected the html body of %s, got %q", name, body)
+		}
+	}
+	listings := fake.requestsTo("GET", "/courses/101/pages")
+	secondPage := false
+	for _, req := range listings {
+		secondPage = secondPage || (req.Path == "/courses/101/pages" && req.Query.Get("page") == "2")
+	}
+	if !secondPage {
+		t.Errorf("expected the second page of the listing to be requested, got %v", listings)
+	}
+}
+
+func TestPushPageRendersMarkdownToEverySection(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "intro", "title": "Intro", "body": "<p>old</p>"})
+	fake.add("/courses/102/pages", map[string]interface{}{"url": "intro", "title": "Intro", "body": "<p>old</p>"})
+	setupEasel(t, fake, 101, 102)
+
+	CommandPull(nil, []string{"pages", "intro"})
+	path := filepath.Join(pagesDir, "intro.md")
+	metadata, _ := splitFile(readTestFile(t, path))
+	writeTestFile(t, path, joinFile(metadata, "# Intro\n\nNew *text*.\n"))
+
+	CommandPush(nil, []string{"pages"})
+
+	want := renderMarkdown("# Intro\n\nNew *text*.\n")
+	for _, courseId := range []int{101, 102} {
+		puts := fake.requestsTo("PUT", fmt.Sprintf("/courses/%d/pages/intro", courseId))
+		if len(puts) != 1 {
+			t.Fatalf("expected one PUT to course %d, got %d", courseId, len(puts))
+		}
+		wikiPage := puts[0].Body["wiki_page"].(map[string]interface{})
+		if wikiPage["body"] != want || wikiPage["title"] != "Intro" {
+			t.Errorf("expected the rendered page to be sent to course %d, got %v", courseId, wikiPage)
+		}
+	}
+	if body := fake.find("/courses/101/pages", "intro")["body"]; body != want {
+		t.Errorf("expected Canvas to have the new body, got %q", body)
+	}
+}
+
+func TestPushAssignmentCreatesThenUpdates(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	setupEasel(t, fake, 101)
+
+	path := filepath.Join(assignmentsDir, "homework-1.md")
+	writeTestFile(t, path, joinFile("name: Homework 1\npoints_possible: 10\npublished: true\n", "Write a *program*.\n"))
+
+	CommandPush(nil, []string{"assignments"})
+	posts := fake.requestsTo("POST", "/courses/101/assignments")
+	if len(posts) != 1 {
+		t.Fatalf("expected the assignment to be created, got %d POSTs", len(posts))
+	}
+	created := posts[0].Body["assignment"].(map[string]interface{})
+	if created["name"] != "Homework 1" || created["points_possible"] != 10.0 || created["description"] != renderMarkdown("Write a *program*.\n") {
+		t.Errorf("unexpected assignment sent: %v", created)
+	}
+
+	CommandPush(nil, []string{"assignments", path})
+	if posts := fake.requestsTo("POST", "/courses/101/assignments"); len(posts) != 1 {
+		t.Errorf("expected the second push to update the assignment, got %d POSTs", len(posts))
+	}
+	if fake.find("/courses/101/assignments", "1001") == nil {
+		t.Fatalf("expected the assignment to exist in Canvas")
+	}
+	if puts := fake.requestsTo("PUT", "/courses/101/assignments/1001"); len(puts) != 1 {
+		t.Errorf("expected the second push to PUT the created assignment, got %d PUTs", len(puts))
+	}
+}
+
+func TestPullQuizWithQuestions(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	quizId := fake.add("/courses/101/quizzes", map[string]interface{}{
+		"title":       "Quiz 1",
+		"description": "<p>Good luck</p>",
+		"time_limit":  20,
+	})
+	fake.add(fmt.Sprintf("/courses/101/quizzes/%d/questions", quizId), map[string]interface{}{
+		"quiz_id":       quizId,
+		"question_name": "Question 1",
+		"question_type": "true_false_question",
+		"question_text": "<p>Is it true?</p>",
+		"answers":       []map[string]interface{}{{"text": "True", "weight": 100}, {"text": "False", "weight": 0}},
+	})
+	setupEasel(t, fake, 101)
+
+	CommandPull(nil, []string{"quizzes"})
+
+	quiz := &Quiz{Title: "Quiz 1"}
+	metadata, body := splitFile(readTestFile(t, quiz.Filepath()))
+	if !strings.Contains(metadata, "time_limit: 20") || body != "<p>Good luck</p>" {
+		t.Errorf("unexpected quiz file: %q %q", metadata, body)
+	}
+	questions := readTestFile(t, quiz.questionsFilepath())
+	if !strings.Contains(questions, "question_name: Question 1") || !strings.Contains(questions, `text: "True"`) {
+		t.Errorf("expected the questions to be pulled, got %q", questions)
+	}
+}
+
+func TestPullModulesAndAssignmentGroups(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1, "published": true})
+	fake.add("/courses/101/assignment_groups", map[string]interface{}{"name": "Labs", "position": 1, "group_weight": 40})
+	setupEasel(t, fake, 101)
+
+	CommandPull(nil, []string{"modules"})
+	CommandPull(nil, []string{"assignment_groups"})
+
+	module := readTestFile(t, (&Module{Name: "Week 1"}).Filepath())
+	if !strings.Contains(module, "name: Week 1") || !strings.Contains(module, "published: true") {
+		t.Errorf("unexpected module file: %q", module)
+	}
+	group := readTestFile(t, (&AssignmentGroup{Name: "Labs"}).Filepath())
+	if !strings.Contains(group, "name: Labs") || !strings.Contains(group, "group_weight: 40") {
+		t.Errorf("unexpected assignment group file: %q", group)
+	}
+}
+
+func TestPushExternalTools(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	setupEasel(t, fake, 101)
+
+	writeTestFile(t, filepath.Join(externalToolsDir, "grader.yaml"),
+		"name: Grader\nconsumer_key: key\nshared_secret: secret\nconfig_type: by_url\nconfig_url: https://grader.example.com/config.xml\n")
+
+	CommandPush(nil, []string{"external_tools"})
+
+	posts := fake.requestsTo("POST", "/courses/101/external_tools")
+	if len(posts) != 1 || posts[0].Body["name"] != "Grader" || posts[0].Body["config_type"] != "by_url" {
+		t.Errorf("expected the external tool to be created, got %v", posts)
+	}
+}
+
+func TestPushSyllabus(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "<p>Welcome</p>")
+	setupEasel(t, fake, 101)
+
+	writeTestFile(t, syllabusFile, "# Syllabus\n")
+	CommandPush(nil, []string{"courses"})
+
+	if syllabus := fake.courses[101]["syllabus_body"]; syllabus != renderMarkdown("# Syllabus\n") {
+		t.Errorf("expected the rendered syllabus in Canvas, got %q", syllabus)
+	}
+}
+
+func TestDryRunSendsNothing(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	setupEasel(t, fake, 101)
+
+	writeTestFile(t, filepath.Join(pagesDir, "intro.md"), joinFile("title: Intro\n", "Hello\n"))
+	writeTestFile(t, filepath.Join(assignmentsDir, "homework-1.md"), joinFile("name: Homework 1\n", "Hello\n"))
+	Config.dryRun = true
+	CommandPush(nil, []string{"pages"})
+	CommandPush(nil, []string{"assignments"})
+
+	if changes := len(fake.requestsTo("PUT", "/")) + len(fake.requestsTo("POST", "/")); changes != 0 {
+		t.Errorf("expected a dry run not to change anything, got %d requests", changes)
+	}
+	if fake.find("/courses/101/pages", "intro") != nil {
+		t.Errorf("expected the page not to be created")
+	}
+}
+
+func TestCanvasErrors(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+
+	client := NewCanvasClient(fake.server.URL, fakeToken)
+	page := new(Page)
+	err := client.getObject("/courses/101/pages/missing", nil, page)
+	canvasErr, ok := err.(*CanvasError)
+	if !ok {
+		t.Fatalf("expected a CanvasError, got %v", err)
+	}
+	if canvasErr.StatusCode != 404 || canvasErr.Path != "/courses/101/pages/missing" ||
+		len(canvasErr.Messages) != 1 || canvasErr.Messages[0] != "The specified resource does not exist." {
+		t.Errorf("unexpected error: %#v", canvasErr)
+	}
+	if found, err := client.findObject("/courses/101/pages/missing", nil, page); found || err != nil {
+		t.Errorf("expected a missing page not to be an error for findObject, got %v, %v", found, err)
+	}
+
+	client = NewCanvasClient(fake.server.URL, "wrong-token")
+	err = client.getObject("/courses/101", nil, new(Course))
+	if canvasErr, ok := err.(*CanvasError); !ok || canvasErr.StatusCode != 401 {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestFailedPushCarriesOn(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	setupEasel(t, fake, 101)
+
+	writeTestFile(t, filepath.Join(pagesDir, "a.md"), joinFile("title: A\n", "A\n"))
+	writeTestFile(t, filepath.Join(pagesDir, "b.md"), joinFile("title: B\n", "B\n"))
+	fake.failWith("PUT", "/courses/101/pages/a", 400)
+
+	db, courses := openTestDb(t)
+	if err := pushAll(t, db, courses, "pages"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failures) != 1 || failures[0].item != "push page a" {
+		t.Fatalf("expected page a to fail, got %v", failures)
+	}
+	if msg := failures[0].err.Error(); !strings.Contains(msg, "400") || !strings.Contains(msg, "Something went wrong.") {
+		t.Errorf("expected the failure to carry Canvas's error, got %v", msg)
+	}
+	if fake.find("/courses/101/pages", "b") == nil {
+		t.Errorf("expected page b to be pushed after page a failed")
+	}
+	failures = nil
+}
+
+func TestReplayRecordedPull(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "<p>Welcome</p>")
+	fake.pageSize = 1
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "intro", "title": "Intro", "body": "<p>Intro</p>"})
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "loops", "title": "Loops", "body": "<p>Loops</p>"})
+	fixtures := t.TempDir()
+
+	setupEasel(t, fake)
+	Config.record = fixtures
+	before := len(fake.requestsTo("GET", "/"))
+	CommandCourseAdd(nil, []string{fake.server.URL + "/courses/101"})
+	CommandPull(nil, []string{"pages"})
+	recorded := readTestFile(t, filepath.Join(pagesDir, "loops.md"))
+	requests := len(fake.requestsTo("GET", "/")) - before
+
+	names, err := fixtureFiles(fixtures)
+	if err != nil || len(names) != requests {
+		t.Fatalf("expected a fixture for each of the %d requests, got %v (%v)", requests, names, err)
+	}
+	if fixture := readTestFile(t, filepath.Join(fixtures, names[0])); strings.Contains(fixture, fakeToken) {
+		t.Errorf("expected the token not to be recorded, got %s", fixture)
+	}
+
+	// replay into a fresh directory with Canvas gone
+	setupEasel(t, fake)
+	fake.server.Close()
+	Config.replay = fixtures
+	CommandCourseAdd(nil, []string{fake.server.URL + "/courses/101"})
+	CommandPull(nil, []string{"pages"})
+
+	if replayed := readTestFile(t, filepath.Join(pagesDir, "loops.md")); replayed != recorded {
+		t.Errorf("expected the replayed pull to match the recorded one, got %q, want %q", replayed, recorded)
+	}
+	if syllabus := readTestFile(t, syllabusFile); syllabus != "<p>Welcome</p>" {
+		t.Errorf("expected the syllabus from the fixtures, got %q", syllabus)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	work := newFakeCanvas(t)
+	work.addCourse(101, "CS 1400-01 Fundamentals", "<p>Work</p>")
+	beta := newFakeCanvas(t)
+	beta.addCourse(101, "CS 1400-01 Fundamentals", "<p>Beta</p>")
+	setupEasel(t, work)
+
+	Config.profile = "beta"
+	CommandLogin(nil, []string{beta.server.URL, fakeToken})
+	rc := mustReadRc()
+	if rc.Default != defaultProfile || len(rc.Profiles) != 2 || rc.Profiles["beta"].Host != beta.server.URL {
+		t.Fatalf("expected a default and a beta profile, got %+v", rc)
+	}
+
+	// adding a course pins the profile it came from
+	CommandCourseAdd(nil, []string{beta.server.URL + "/courses/101"})
+	if syllabus := readTestFile(t, syllabusFile); syllabus != "<p>Beta</p>" {
+		t.Errorf("expected the course from the beta profile, got %q", syllabus)
+	}
+	Config.profile = ""
+	if name, source := activeProfile(mustReadRc()); name != "beta" || source != easelDb {
+		t.Errorf("expected beta to be pinned, got %s from %s", name, source)
+	}
+	CommandPush(nil, []string{"courses"})
+	if len(beta.requestsTo("PUT", "/courses/101")) != 1 || len(work.requestsTo("PUT", "/")) != 0 {
+		t.Errorf("expected the push to go to the pinned profile")
+	}
+
+	// the environment overrides the pin
+	t.Setenv(profileEnv, defaultProfile)
+	mustLoadConfig()
+	if Config.Host != work.server.URL {
+		t.Errorf("expected $%s to choose the default profile, got %s", profileEnv, Config.Host)
+	}
+	os.Unsetenv(profileEnv)
+
+	CommandProfileUse(nil, []string{"beta"})
+	CommandProfileRemove(nil, []string{defaultProfile})
+	if rc := mustReadRc(); rc.Default != "beta" || len(rc.Profiles) != 1 {
+		t.Errorf("expected only the beta profile to be left, got %+v", rc)
+	}
+}
+
+func TestOldConfigFile(t *testing.T) {
+	setupEasel(t, newFakeCanvas(t))
+	writeTestFile(t, rcPath(), `{"host": "canvas.example.edu", "token": "secret"}`)
+
+	mustLoadConfig()
+	if Config.profileInUse != defaultProfile || Config.Host != "canvas.example.edu" || Config.Token != "secret" {
+		t.Errorf("expected the old login to become the default profile, got %s %s", Config.profileInUse, Config.Host)
+	}
+}
+
+func TestLoginKeepsTokenSafe(t *testing.T) {
+	fake := newFakeCanvas(t)
+	setupEasel(t, fake)
+
+	if rc := readTestFile(t, rcPath()); strings.Contains(rc, fakeToken) {
+		t.Errorf("expected the token not to be in the config file, got %s", rc)
+	}
+	for _, path := range []string{rcPath(), tokenFilePath()} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("expected %s to only be readable by the user, got %v", path, mode)
+		}
+	}
+	if tokens := readTestFile(t, tokenFilePath()); strings.Contains(tokens, fakeToken) {
+		t.Errorf("expected the token to be encrypted, got %s", tokens)
+	}
+	if len(fake.requestsTo("GET", selfPath)) != 1 {
+		t.Errorf("expected login to check the token")
+	}
+
+	// a fresh run has to decrypt it again
+	tokenKeys = make(map[string][]byte)
+	mustLoadConfig()
+	if Config.Token != fakeToken {
+		t.Errorf("expected to load the stored token, got %q", Config.Token)
+	}
+
+	tokenKeys = make(map[string][]byte)
+	t.Setenv(passphraseEnv, "wrong passphrase")
+	if _, err := fileLookup(defaultProfile); err != errWrongPassphrase {
+		t.Errorf("expected the wrong passphrase to be rejected, got %v", err)
+	}
+
+	t.Setenv(tokenEnv, "ci-token")
+	mustLoadConfig()
+	if Config.Token != "ci-token" {
+		t.Errorf("expected $%s to override the stored token, got %q", tokenEnv, Config.Token)
+	}
+}
+
+func TestPbkdf2(t *testing.T) {
+	// from RFC 7914, section 11
+	key := pbkdf2Sha256([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if fmt.Sprintf("%x", key) != want {
+		t.Errorf("pbkdf2Sha256 = %x, want %s", key, want)
+	}
+}
+
+func TestOAuthLoginAndRefresh(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "<p>Welcome</p>")
+	setupEasel(t, fake)
+
+	// stand in for the user approving easel in their browser
+	defer func(original func(string) error) { openBrowser = original }(openBrowser)
+	openBrowser = func(target string) error {
+		resp, err := http.Get(target)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	Config.profile = "oauth"
+	Config.useOAuth, Config.clientId, Config.clientSecret = true, "10000000000001", "fake-secret"
+	CommandLogin(nil, []string{fake.server.URL})
+	Config.useOAuth = false
+
+	rc := mustReadRc()
+	if profile := rc.Profiles["oauth"]; profile == nil || profile.ClientId != "10000000000001" {
+		t.Fatalf("expected an OAuth profile, got %+v", rc.Profiles)
+	}
+	exchanges := fake.requestsTo("POST", oauthTokenPath)
+	if len(exchanges) != 1 || exchanges[0].Form.Get("grant_type") != "authorization_code" {
+		t.Fatalf("expected the code to be exchanged for a token, got %v", exchanges)
+	}
+	if tokens := readTestFile(t, tokenFilePath()); strings.Contains(tokens, "fake-refresh") || strings.Contains(tokens, "fake-secret") {
+		t.Errorf("expected the OAuth tokens to be encrypted, got %s", tokens)
+	}
+
+	mustLoadConfig()
+	if Config.oauth == nil {
+		t.Fatalf("expected the profile to use OAuth")
+	}
+	fake.revoke(Config.oauth.token.AccessToken)
+	CommandCourseAdd(nil, []string{fake.server.URL + "/courses/101"})
+	if syllabus := readTestFile(t, syllabusFile); syllabus != "<p>Welcome</p>" {
+		t.Errorf("expected the course to be added after refreshing, got %q", syllabus)
+	}
+	refreshes := fake.requestsTo("POST", oauthTokenPath)[1:]
+	if len(refreshes) != 1 || refreshes[0].Form.Get("grant_type") != "refresh_token" || refreshes[0].Form.Get("refresh_token") != "fake-refresh" {
+		t.Errorf("expected one refresh, got %v", refreshes)
+	}
+
+	// the refreshed token was saved for next time
+	tokenKeys = make(map[string][]byte)
+	mustLoadConfig()
+	if token := Config.oauth.token; !fake.tokens[token.AccessToken] || token.RefreshToken != "fake-refresh" {
+		t.Errorf("expected the refreshed token to be stored, got %+v", token)
+	}
+}
+
+// questionNames lists the names of the questions in the fake quiz, in order.
+func questionNames(fake *fakeCanvas, path string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	names := []string{}
+	for _, question := range fake.lists[path] {
+		names = append(names, question["question_name"].(string))
+	}
+	return names
+}
+
+func TestPushQuizReconcilesQuestions(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	quizId := fake.add("/courses/101/quizzes", map[string]interface{}{"title": "Quiz 1", "description": "<p>Good luck</p>"})
+	questionsPath := fmt.Sprintf("/courses/101/quizzes/%d/questions", quizId)
+	for _, name := range []string{"Q1", "Q2", "Q3"} {
+		fake.add(questionsPath, map[string]interface{}{
+			"quiz_id":       quizId,
+			"question_name": name,
+			"question_type": "true_false_question",
+			"question_text": "<p>" + name + "?</p>",
+			"answers":       []map[string]interface{}{{"id": 1, "text": "True", "weight": 100}, {"id": 2, "text": "False", "weight": 0}},
+		})
+	}
+	setupEasel(t, fake, 101, 102)
+	CommandPull(nil, []string{"quizzes"})
+
+	// drop Q2, move Q3 to the front, change Q1, and add Q4
+	quiz := &Quiz{Title: "Quiz 1"}
+	questions, err := quiz.readQuizQuestions()
+	if err != nil || len(questions) != 3 {
+		t.Fatalf("expected the pulled questions, got %v (%v)", questions, err)
+	}
+	questions[0].QuestionText = "<p>Q1, changed?</p>"
+	added := &QuizQuestion{QuestionName: "Q4", QuestionType: "essay_question", QuestionText: "<p>Why?</p>", PointsPossible: 5}
+	questions = []*QuizQuestion{questions[2], questions[0], added}
+	raw, err := yaml.Marshal(questions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, quiz.questionsFilepath(), string(raw))
+
+	CommandPush(nil, []string{"quizzes"})
+
+	if names := questionNames(fake, questionsPath); strings.Join(names, ",") != "Q3,Q1,Q4" {
+		t.Errorf("expected the questions in course 101 to match the file, got %v", names)
+	}
+	if text := fake.find(questionsPath, strconv.Itoa(questions[1].CanvasId))["question_text"]; text != "<p>Q1, changed?</p>" {
+		t.Errorf("expected Q1 to be updated, got %v", text)
+	}
+	if deletes := fake.requestsTo("DELETE", questionsPath); len(deletes) != 1 {
+		t.Errorf("expected Q2 to be deleted, got %v", deletes)
+	}
+	posts := fake.requestsTo("POST", questionsPath)
+	if len(posts) != 1 {
+		t.Fatalf("expected Q4 to be created in course 101, got %v", posts)
+	}
+	if answers, _ := posts[0].Body["question"].(map[string]interface{})["answers"].([]interface{}); len(answers) != 0 {
+		t.Errorf("expected Q4 to have no answers, got %v", answers)
+	}
+	update := fake.requestsTo("PUT", questionsPath)[0].Body["question"].(map[string]interface{})
+	if answer := update["answers"].([]interface{})[0].(map[string]interface{}); answer["answer_text"] != "True" || answer["answer_weight"] != 100.0 || answer["id"] != nil {
+		t.Errorf("expected answers in the form Canvas takes them, got %v", answer)
+	}
+
+	// course 102 gets a new quiz with the same questions
+	created := fake.requestsTo("POST", "/courses/102/quizzes")
+	if len(created) == 0 || created[0].Path != "/courses/102/quizzes" {
+		t.Fatalf("expected the quiz to be created in course 102, got %v", created)
+	}
+	db, courses := openTestDb(t)
+	newQuizId, err := findCanvasId(db, "quiz", quiz.Slug(), courses[1])
+	if err != nil || newQuizId == 0 {
+		t.Fatalf("expected the new quiz to be recorded, got %d (%v)", newQuizId, err)
+	}
+	if names := questionNames(fake, fmt.Sprintf("/courses/102/quizzes/%d/questions", newQuizId)); strings.Join(names, ",") != "Q3,Q1,Q4" {
+		t.Errorf("expected the questions in course 102 to match the file, got %v", names)
+	}
+
+	// Q4 took its id from course 101
+	saved, err := quiz.readQuizQuestions()
+	if err != nil || len(saved) != 3 || saved[2].CanvasId == 0 {
+		t.Fatalf("expected Q4's new id to be saved, got %v (%v)", saved, err)
+	}
+
+	// pushing again only updates and reorders
+	posted, deleted := len(fake.requestsTo("POST", "/")), len(fake.requestsTo("DELETE", "/"))
+	CommandPush(nil, []string{"quizzes", quiz.questionsFilepath()})
+	for _, req := range fake.requestsTo("POST", "/")[posted:] {
+		if !strings.HasSuffix(req.Path, "/reorder") {
+			t.Errorf("expected the second push to only update and reorder, got POST %s", req.Path)
+		}
+	}
+	if len(fake.requestsTo("DELETE", "/")) != deleted {
+		t.Errorf("expected the second push not to delete anything")
+	}
+}
+
+func TestPushModuleResolvesItemsInEachSection(t *testing.T) {
+	fake := newFakeCanvas(t)
+	contentIds := make(map[int]map[string]int)
+	for _, course := range []int{101, 102} {
+		fake.addCourse(course, fmt.Sprintf("CS 1400-%02d Fundamentals", course-100), "")
+		prefix := fmt.Sprintf("/courses/%d", course)
+		fake.add(prefix+"/pages", map[string]interface{}{"url": "lesson-1", "title": "Lesson 1", "body": "<p>Hi</p>"})
+		contentIds[course] = map[string]int{
+			"assignment": fake.add(prefix+"/assignments", map[string]interface{}{"name": "Programming 01"}),
+			"quiz":       fake.add(prefix+"/quizzes", map[string]interface{}{"title": "Quiz 1"}),
+		}
+	}
+	week1 := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	week2 := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 2", "position": 2, "prerequisite_module_ids": []int{week1}})
+	itemsPath := fmt.Sprintf("/courses/101/modules/%d/items", week2)
+	fake.add(itemsPath, map[string]interface{}{"title": "Start here", "type": "SubHeader", "position": 1})
+	fake.add(itemsPath, map[string]interface{}{"title": "Lesson 1", "type": "Page", "page_url": "lesson-1", "position": 2})
+	fake.add(itemsPath, map[string]interface{}{"title": "Programming 01", "type": "Assignment", "content_id": contentIds[101]["assignment"], "position": 3,
+		"completion_requirement": map[string]interface{}{"type": "must_submit"}})
+	fake.add(itemsPath, map[string]interface{}{"title": "Quiz 1", "type": "Quiz", "content_id": contentIds[101]["quiz"], "position": 4})
+	setupEasel(t, fake, 101, 102)
+
+	CommandPull(nil, []string{"assignments"})
+	CommandPull(nil, []string{"quizzes"})
+	CommandPull(nil, []string{"modules"})
+
+	filepath := (&Module{Name: "Week 2"}).Filepath()
+	contents := readTestFile(t, filepath)
+	for _, expected := range []string{"page: lesson-1", "assignment: programming-01", "quiz: quiz-1", "prerequisites:\n- week-1"} {
+		if !strings.Contains(contents, expected) {
+			t.Errorf("expected the pulled module to contain %q, got %q", expected, contents)
+		}
+	}
+
+	// drop the subheader, move the quiz to the front, and indent the page
+	module := new(Module)
+	if err := readYamlFile(filepath, module); err != nil {
+		t.Fatal(err)
+	}
+	page, assignment, quiz := module.Items[1], module.Items[2], module.Items[3]
+	page.Indent = 1
+	module.Items = []ModuleItem{quiz, page, assignment}
+	raw, err := yaml.Marshal(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath, string(raw))
+
+	CommandPush(nil, []string{"modules"})
+
+	if titles := itemTitles(fake, itemsPath); strings.Join(titles, ",") != "Quiz 1,Lesson 1,Programming 01" {
+		t.Errorf("expected the items in course 101 to match the file, got %v", titles)
+	}
+	if len(fake.requestsTo("DELETE", itemsPath)) != 1 || len(fake.requestsTo("POST", itemsPath)) != 0 {
+		t.Errorf("expected course 101 to only lose the subheader")
+	}
+
+	// course 102 gets both modules, linked to its own copies of everything
+	db, courses := openTestDb(t)
+	week1Id, _ := findCanvasId(db, "module", "week-1", courses[1])
+	week2Id, _ := findCanvasId(db, "module", "week-2", courses[1])
+	if week1Id == 0 || week2Id == 0 {
+		t.Fatalf("expected both modules to be created in course 102, got %d and %d", week1Id, week2Id)
+	}
+	created := fake.find("/courses/102/modules", strconv.Itoa(week2Id))
+	if prerequisites := created["prerequisite_module_ids"].([]interface{}); len(prerequisites) != 1 || toFloat(prerequisites[0]) != float64(week1Id) {
+		t.Errorf("expected week 2 to require course 102's week 1, got %v", prerequisites)
+	}
+	items := fake.requestsTo("POST", fmt.Sprintf("/courses/102/modules/%d/items", week2Id))
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items to be created in course 102, got %v", items)
+	}
+	sent := func(i int) map[string]interface{} { return items[i].Body["module_item"].(map[string]interface{}) }
+	if toFloat(sent(0)["content_id"]) != float64(contentIds[102]["quiz"]) || sent(0)["type"] != "Quiz" {
+		t.Errorf("expected the quiz item to link to course 102's quiz, got %v", sent(0))
+	}
+	if sent(1)["page_url"] != "lesson-1" || toFloat(sent(1)["indent"]) != 1 {
+		t.Errorf("expected the indented page item, got %v", sent(1))
+	}
+	if toFloat(sent(2)["content_id"]) != float64(contentIds[102]["assignment"]) ||
+		sent(2)["completion_requirement"].(map[string]interface{})["type"] != "must_submit" {
+		t.Errorf("expected the assignment item to link to course 102's assignment, got %v", sent(2))
+	}
+}
+
+// itemTitles lists the titles of the items in the fake module, in order.
+func itemTitles(fake *fakeCanvas, path string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	titles := []string{}
+	for _, item := range fake.lists[path] {
+		titles = append(titles, item["title"].(string))
+	}
+	return titles
+}
+
+func TestPushAssignmentGroupsAndTheirAssignments(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	labs := fake.add("/courses/101/assignment_groups", map[string]interface{}{"name": "Labs", "position": 1, "group_weight": 40})
+	lab1 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1", "assignment_group_id": labs})
+	fake.find("/courses/101/assignment_groups", strconv.Itoa(labs))["rules"] = map[string]interface{}{"drop_lowest": 1, "never_drop": []int{lab1}}
+	setupEasel(t, fake, 101, 102)
+
+	CommandPull(nil, []string{"assignment_groups"})
+	CommandPull(nil, []string{"assignments"})
+
+	group := readTestFile(t, (&AssignmentGroup{Name: "Labs"}).Filepath())
+	if !strings.Contains(group, "drop_lowest: 1") || !strings.Contains(group, "- lab-1") {
+		t.Errorf("expected the rules to name the assignment, got %q", group)
+	}
+	if assignment := readTestFile(t, (&Assignment{Name: "Lab 1"}).Filepath()); !strings.Contains(assignment, "assignment_group: labs") {
+		t.Errorf("expected the assignment to name its group, got %q", assignment)
+	}
+
+	Config.applyWeights = true
+	CommandPush(nil, []string{"assignment_groups"})
+	Config.applyWeights = false
+
+	created := fake.requestsTo("POST", "/courses/102/assignment_groups")
+	if len(created) != 1 || created[0].Body["group_weight"] != 40.0 {
+		t.Fatalf("expected the group to be created in course 102, got %v", created)
+	}
+	if neverDrop := created[0].Body["rules"].(map[string]interface{})["never_drop"].([]interface{}); len(neverDrop) != 0 {
+		t.Errorf("expected lab-1 to be left out of never_drop until it's in course 102, got %v", neverDrop)
+	}
+	for _, course := range []string{"/courses/101", "/courses/102"} {
+		puts := fake.requestsTo("PUT", course)
+		if last := puts[len(puts)-1]; last.Path != course || last.Body["course"].(map[string]interface{})["apply_assignment_group_weights"] != true {
+			t.Errorf("expected group weights to be applied in %s, got %v", course, last)
+		}
+	}
+
+	// the assignment goes in course 102's copy of the group
+	CommandPush(nil, []string{"assignments"})
+	db, courses := openTestDb(t)
+	groupId, _ := findCanvasId(db, "assignment_group", "labs", courses[1])
+	posted := fake.requestsTo("POST", "/courses/102/assignments")
+	if len(posted) != 1 || toFloat(posted[0].Body["assignment"].(map[string]interface{})["assignment_group_id"]) != float64(groupId) {
+		t.Fatalf("expected the assignment to be created in course 102's group %d, got %v", groupId, posted)
+	}
+	if sent := fake.requestsTo("PUT", "/courses/101/assignments")[0].Body["assignment"].(map[string]interface{}); toFloat(sent["assignment_group_id"]) != float64(labs) {
+		t.Errorf("expected the assignment to stay in course 101's group, got %v", sent["assignment_group_id"])
+	}
+
+	// now that the assignment is there, the group can name it
+	CommandPush(nil, []string{"assignment_groups", (&AssignmentGroup{Name: "Labs"}).Filepath()})
+	lab1Copy, _ := findCanvasId(db, "assignment", "lab-1", courses[1])
+	puts := fake.requestsTo("PUT", "/courses/102/assignment_groups")
+	if len(puts) != 1 || fmt.Sprint(puts[0].Body["rules"].(map[string]interface{})["never_drop"]) != fmt.Sprintf("[%d]", lab1Copy) {
+		t.Errorf("expected course 102's group to never drop its copy of lab 1 (%d), got %v", lab1Copy, puts)
+	}
+}
+
+func TestPushPruneDeletesWhatWasDeletedLocally(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	for _, url := range []string{"lesson-1", "old-lesson"} {
+		fake.add("/courses/101/pages", map[string]interface{}{"url": url, "title": url, "body": "<p>Hi</p>"})
+	}
+	labs := fake.add("/courses/101/assignment_groups", map[string]interface{}{"name": "Labs"})
+	oldLab := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Old Lab", "assignment_group_id": labs})
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"pages"})
+	CommandPull(nil, []string{"assignments"})
+	CommandPull(nil, []string{"assignment_groups"})
+
+	// made in Canvas after the pull, so easel has never synced it
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "canvas-only", "title": "Canvas only"})
+	for _, path := range []string{"pages/old-lesson.md", "assignments/old-lab.md", "assignment_groups/labs.md"} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Config.prune = true
+	saved := stdin
+	t.Cleanup(func() { stdin = saved })
+
+	Config.dryRun = true
+	CommandPush(nil, nil)
+	Config.dryRun = false
+	if deletes := fake.requestsTo("DELETE", "/"); len(deletes) != 0 {
+		t.Fatalf("expected a dry run not to delete anything, got %v", deletes)
+	}
+
+	stdin = bufio.NewReader(strings.NewReader("n\n"))
+	CommandPush(nil, []string{"assignments"})
+	if deletes := fake.requestsTo("DELETE", "/"); len(deletes) != 0 {
+		t.Fatalf("expected nothing to be deleted without confirmation, got %v", deletes)
+	}
+
+	stdin = bufio.NewReader(strings.NewReader("y\n"))
+	CommandPush(nil, nil)
+	deleted := []string{}
+	for _, req := range fake.requestsTo("DELETE", "/") {
+		deleted = append(deleted, req.Path)
+	}
+	expected := []string{"/courses/101/pages/old-lesson", fmt.Sprintf("/courses/101/assignments/%d", oldLab), fmt.Sprintf("/courses/101/assignment_groups/%d", labs)}
+	if strings.Join(deleted, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v to be deleted, in order, got %v", expected, deleted)
+	}
+	if fake.find("/courses/101/pages", "lesson-1") == nil || fake.find("/courses/101/pages", "canvas-only") == nil {
+		t.Errorf("expected pages that weren't deleted locally to be left alone")
+	}
+
+	// what was deleted is forgotten, so there's nothing left to prune
+	Config.yes = true
+	CommandPush(nil, nil)
+	if deletes := fake.requestsTo("DELETE", "/"); len(deletes) != len(expected) {
+		t.Errorf("expected a second prune to delete nothing, got %v", deletes[len(expected):])
+	}
+}
+
+func TestPullAndPushGradedGroupDiscussion(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	teams := fake.add("/courses/101/group_categories", map[string]interface{}{"name": "Teams"})
+	labs := fake.add("/courses/101/assignment_groups", map[string]interface{}{"name": "Labs"})
+	graded := fake.add("/courses/101/assignments", map[string]interface{}{
+		"name": "Design review", "points_possible": 10, "grading_type": "points", "due_at": "2020-09-14T06:00:00Z", "assignment_group_id": labs,
+	})
+	fake.add("/courses/101/discussion_topics", map[string]interface{}{
+		"title": "Design review", "message": "<p>Post your design</p>", "discussion_type": "threaded",
+		"delayed_post_at": "2020-09-07T06:00:00Z", "lock_at": "2020-09-21T06:00:00Z",
+		"assignment_id": graded, "group_category_id": teams,
+	})
+	otherTeams := fake.add("/courses/102/group_categories", map[string]interface{}{"name": "Teams"})
+	otherLabs := fake.add("/courses/102/assignment_groups", map[string]interface{}{"name": "Labs"})
+	setupEasel(t, fake, 101, 102)
+
+	CommandPull(nil, []string{"assignment_groups"})
+	CommandPull(nil, []string{"discussions"})
+
+	topic := readTestFile(t, (&DiscussionTopic{Title: "Design review"}).Filepath())
+	for _, expected := range []string{"discussion_type: threaded", "group_category: Teams", "assignment_group: labs", "points_possible: 10", "lock_at: \"2020-09-21T06:00:00Z\"", "Post your design"} {
+		if !strings.Contains(topic, expected) {
+			t.Errorf("expected the discussion file to contain %q, got %q", expected, topic)
+		}
+	}
+
+	CommandPush(nil, []string{"discussions"})
+
+	for _, c := range []struct {
+		method, path string
+		teams, labs  int
+	}{
+		{"PUT", "/courses/101/discussion_topics", teams, labs},
+		{"POST", "/courses/102/discussion_topics", otherTeams, otherLabs},
+	} {
+		sent := fake.requestsTo(c.method, c.path)
+		if len(sent) != 1 {
+			t.Fatalf("expected one %s to %s, got %v", c.method, c.path, sent)
+		}
+		assignment, _ := sent[0].Body["assignment"].(map[string]interface{})
+		if toFloat(sent[0].Body["group_category_id"]) != float64(c.teams) || toFloat(assignment["assignment_group_id"]) != float64(c.labs) {
+			t.Errorf("expected %s to use group set %d and assignment group %d, got %v", c.path, c.teams, c.labs, sent[0].Body)
+		}
+		if assignment["points_possible"] != 10.0 || sent[0].Body["discussion_type"] != "threaded" {
+			t.Errorf("expected the settings to be pushed to %s, got %v", c.path, sent[0].Body)
+		}
+	}
+}
+
+// statuses gets the status of everything in the first course, by type and id.
+func statuses(t *testing.T) map[string]string {
+	db, courses := openTestDb(t)
+	found, err := courseStatus(newClient(), db, courses[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	byId := make(map[string]string)
+	for _, status := range found {
+		byId[status.componentType+" "+status.componentId] = status.status
+	}
+	return byId
+}
+
+func TestStatusReportsWhoChangedWhat(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	// pages are matched up by page_id, which the fake doesn't make up
+	for i, url := range []string{"intro", "lesson-1", "lesson-2", "old-lesson"} {
+		fake.add("/courses/101/pages", map[string]interface{}{"url": url, "page_id": 501 + i, "title": url, "body": "<p>Hi</p>"})
+	}
+	fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1"})
+	quizId := fake.add("/courses/101/quizzes", map[string]interface{}{"title": "Quiz 1"})
+	questionsPath := fmt.Sprintf("/courses/101/quizzes/%d/questions", quizId)
+	questionId := fake.add(questionsPath, map[string]interface{}{"quiz_id": quizId, "question_name": "Q1", "question_type": "essay_question", "question_text": "<p>Why?</p>"})
+	moduleId := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	itemsPath := fmt.Sprintf("/courses/101/modules/%d/items", moduleId)
+	for i, title := range []string{"Start here", "Wrap up"} {
+		fake.add(itemsPath, map[string]interface{}{"title": title, "type": "SubHeader", "position": i + 1})
+	}
+	setupEasel(t, fake, 101)
+	for _, kind := range []string{"pages", "assignments", "quizzes", "modules"} {
+		CommandPull(nil, []string{kind})
+	}
+
+	for id, status := range statuses(t) {
+		if status != statusInSync && id != "syllabus syllabus" {
+			t.Errorf("expected everything to be in sync right after a pull, got %s %s", status, id)
+		}
+	}
+
+	writeTestFile(t, "pages/intro.md", readTestFile(t, "pages/intro.md")+"\nMore")
+	writeTestFile(t, "pages/lesson-2.md", readTestFile(t, "pages/lesson-2.md")+"\nMore")
+	writeTestFile(t, "pages/draft.md", "```\nurl: draft\ntitle: Draft\n```\n")
+	if err := os.Remove("pages/old-lesson.md"); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"lesson-1", "lesson-2"} {
+		page := fake.find("/courses/101/pages", url)
+		page["body"], page["updated_at"] = "<p>Changed</p>", "2021-01-01T00:00:00Z"
+	}
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "canvas-only", "page_id": 505, "title": "Canvas only"})
+	// neither of these changes the quiz or the module themselves
+	fake.find(questionsPath, strconv.Itoa(questionId))["question_text"] = "<p>Why not?</p>"
+	items := fake.lists[itemsPath]
+	items[0], items[1] = items[1], items[0]
+	items[0]["position"], items[1]["position"] = 1, 2
+
+	expected := map[string]string{
+		"page intro":       statusModifiedLocal,
+		"page lesson-1":    statusModifiedRemote,
+		"page lesson-2":    statusConflict,
+		"page old-lesson":  statusDeletedLocal,
+		"page draft":       statusNewLocal,
+		"page canvas-only": statusNewRemote,
+		"assignment lab-1": statusInSync,
+		"quiz quiz-1":      statusModifiedRemote,
+		"module week-1":    statusModifiedRemote,
+	}
+	found := statuses(t)
+	for id, status := range expected {
+		if found[id] != status {
+			t.Errorf("expected %s to be %s, got %q", id, status, found[id])
+		}
+	}
+
+	// pushing puts the local versions back, after which both sides agree again
+	CommandPush(nil, []string{"quizzes"})
+	CommandPush(nil, []string{"modules"})
+	found = statuses(t)
+	for _, id := range []string{"quiz quiz-1", "module week-1"} {
+		if found[id] != statusInSync {
+			t.Errorf("expected %s to be in sync after pushing it, got %q", id, found[id])
+		}
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	for _, c := range []struct {
+		name, local, remote, merged string
+		conflicts                   int
+	}{
+		{"only local", "one!\ntwo\nthree\nfour\nfive\n", base, "one!\ntwo\nthree\nfour\nfive\n", 0},
+		{"only remote", base, "one\ntwo\nthree\nfour\nfive!\n", "one\ntwo\nthree\nfour\nfive!\n", 0},
+		{"both, apart", "one!\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nfive!\n", "one!\ntwo\nthree\nfour\nfive!\n", 0},
+		{"both, the same way", "one\ntwo\n3\nfour\nfive\n", "one\ntwo\n3\nfour\nfive\n", "one\ntwo\n3\nfour\nfive\n", 0},
+		{"added and removed", "zero\none\ntwo\nthree\nfour\nfive\n", "one\ntwo\nfour\nfive\n", "zero\none\ntwo\nfour\nfive\n", 0},
+		{"both, differently", "one\ntwo\nthree (local)\nfour\nfive\n", "one\ntwo\nthree (canvas)\nfour\nfive\n",
+			"one\ntwo\n<<<<<<< local\nthree (local)\n=======\nthree (canvas)\n>>>>>>> canvas\nfour\nfive\n", 1},
+		{"everything removed", "", "", "", 0},
+	} {
+		merged, conflicts := merge3(base, c.local, c.remote)
+		if merged != c.merged || conflicts != c.conflicts {
+			t.Errorf("%s: expected %q with %d conflict(s), got %q with %d", c.name, c.merged, c.conflicts, merged, conflicts)
+		}
+	}
+
+	// with nothing in common, both sides were added from scratch
+	if merged, conflicts := merge3("", "local\n", "canvas\n"); conflicts != 1 || !strings.Contains(merged, "<<<<<<< local\nlocal\n=======\ncanvas\n") {
+		t.Errorf("expected new text on both sides to conflict, got %q with %d", merged, conflicts)
+	}
+}
+
+func TestPullMergesAndResolvesConflicts(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "notes", "title": "Notes", "body": "<p>one</p>\n<p>two</p>\n<p>three</p>\n<p>four</p>\n<p>five</p>\n"})
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"pages"})
+	db, courses := openTestDb(t)
+
+	path := filepath.Join(pagesDir, "notes.md")
+	page := fake.find("/courses/101/pages", "notes")
+	// replaces the paragraph that starts with the given word
+	change := func(text, word, to string) string {
+		return regexp.MustCompile(`(?m)^<p>`+word+`.*$`).ReplaceAllString(text, "<p>"+to+"</p>")
+	}
+	pull := func(strategy string) error {
+		Config.strategy = strategy
+		defer func() { Config.strategy = strategyAbort }()
+		return pullPages(newClient(), db, courses)
+	}
+
+	// changes to different lines are merged whatever the strategy
+	writeTestFile(t, path, change(readTestFile(t, path), "one", "one (local)"))
+	page["body"] = change(page["body"].(string), "five", "five (canvas)")
+	if err := pull(strategyAbort); err != nil {
+		t.Fatal(err)
+	}
+	if body := readTestFile(t, path); !strings.Contains(body, "one (local)") || !strings.Contains(body, "five (canvas)") {
+		t.Fatalf("expected both changes to be merged, got %q", body)
+	}
+
+	for i, c := range []struct {
+		strategy, answers string
+		keeps             string // which change to line three ends up in the file
+	}{
+		{strategyKeep, "", "local"},
+		{strategyOverwrite, "", "canvas"},
+		{strategyPrompt, "d\nk\n", "local"},
+		{strategyAbort, "", "before"},
+		{strategyMarkers, "", "<<<<<<< local"},
+	} {
+		before := readTestFile(t, path)
+		writeTestFile(t, path, change(before, "three", fmt.Sprintf("three (local %d)", i)))
+		page["body"] = change(page["body"].(string), "three", fmt.Sprintf("three (canvas %d)", i))
+		saved := stdin
+		stdin = bufio.NewReader(strings.NewReader(c.answers))
+		err := pull(c.strategy)
+		stdin = saved
+
+		body := readTestFile(t, path)
+		switch c.keeps {
+		case "before":
+			if err != errPullAborted || body != change(before, "three", fmt.Sprintf("three (local %d)", i)) {
+				t.Errorf("%s: expected the pull to stop and leave the file alone, got %v and %q", c.strategy, err, body)
+			}
+		case "<<<<<<< local":
+			if err != nil || !strings.Contains(body, fmt.Sprintf("<<<<<<< local\n<p>three (local %d)</p>\n=======\n<p>three (canvas %d)</p>\n>>>>>>> canvas", i, i)) {
+				t.Errorf("%s: expected conflict markers, got %v and %q", c.strategy, err, body)
+			}
+		default:
+			if err != nil || !strings.Contains(body, fmt.Sprintf("three (%s %d)", c.keeps, i)) {
+				t.Errorf("%s: expected the %s version of line three, got %v and %q", c.strategy, c.keeps, err, body)
+			}
+		}
+	}
+}
+
+func TestAbortedPullRecordsNoSyncState(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	lab := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1", "description": "<p>one</p>\n<p>two</p>\n"})
+	fake.add("/courses/102/assignments", map[string]interface{}{"name": "Lab 1", "description": "<p>one</p>\n<p>two</p>\n"})
+	setupEasel(t, fake, 101, 102)
+	CommandPull(nil, []string{"assignments"})
+	db, courses := openTestDb(t)
+	synced := make([]*ComponentCanvasId, len(courses))
+	for i, course := range courses {
+		mapping, err := findComponentCanvasId(db, "assignment", "lab-1", course)
+		if err != nil || mapping == nil || mapping.RemoteHash == "" {
+			t.Fatalf("expected the pull to record lab 1 in %s, got %+v %v", course.Name, mapping, err)
+		}
+		synced[i] = mapping
+	}
+
+	path := (&Assignment{Name: "Lab 1"}).Filepath()
+	before := strings.Replace(readTestFile(t, path), "<p>two</p>", "<p>two (local)</p>", 1)
+	writeTestFile(t, path, before)
+	object := fake.find("/courses/101/assignments", strconv.Itoa(lab))
+	object["description"], object["updated_at"] = "<p>one</p>\n<p>two (canvas)</p>\n", "2020-02-01T00:00:00Z"
+
+	if err := pullAssignments(newClient(), db, courses); err != errPullAborted {
+		t.Fatalf("expected the conflict to abort the pull, got %v", err)
+	}
+	if body := readTestFile(t, path); body != before {
+		t.Errorf("expected the file to be left alone, got %q", body)
+	}
+	for i, course := range courses {
+		mapping, err := findComponentCanvasId(db, "assignment", "lab-1", course)
+		if err != nil || mapping == nil || *mapping != *synced[i] {
+			t.Errorf("expected the sync state in %s to stay %+v, got %+v %v", course.Name, synced[i], mapping, err)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\n"
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -7,4 +7,3 @@
+ g
+ h
+ i
+-j
+`
+	if diff := unifiedDiff("old", "new", from, to); diff != expected {
+		t.Errorf("expected separate hunks for changes far apart, got\n%s", diff)
+	}
+	if diff := unifiedDiff("old", "new", from, from); diff != "" {
+		t.Errorf("expected no diff for the same text, got\n%s", diff)
+	}
+	if diff := unifiedDiff("old", "new", "", "a\n"); diff != "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("expected an added line against nothing, got\n%s", diff)
+	}
+}
+
+func TestDiffShowsWhatPushWouldSend(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "intro", "title": "Intro", "body": "<p>Hi</p>"})
+	setupEasel(t, fake, 101, 102)
+	CommandPull(nil, []string{"pages"})
+
+	writeTestFile(t, filepath.Join(pagesDir, "intro.md"), joinFile("url: intro\ntitle: Intro\n", "Hello, *world*\n"))
+	kind, _ := findComponentKind("pages")
+	local, err := kind.load(filepath.Join(pagesDir, "intro.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, courses := openTestDb(t)
+	diff, err := diffComponent(newClient(), db, courses[0], true, kind, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-<p>Hi</p>") || !strings.Contains(diff, "+<p>Hello, <em>world</em></p>") {
+		t.Errorf("expected the diff to compare Canvas's body with the rendered local one, got\n%s", diff)
+	}
+
+	// a course that doesn't have the page yet gets all of it
+	diff, err = diffComponent(newClient(), db, courses[1], false, kind, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "@@ -0,0 ") || !strings.Contains(diff, "+title: Intro") {
+		t.Errorf("expected the whole page to be new in course 102, got\n%s", diff)
+	}
+}
+
+func TestRetriesTemporaryFailures(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	client := NewCanvasClient(fake.server.URL, fakeToken)
+	client.Retries, client.MaxBackoff = 3, time.Millisecond
+	client.Logger = log.New(ioutil.Discard, "", 0)
+
+	fake.failTimes("GET", "/courses/101", http.StatusServiceUnavailable, 2)
+	if err := client.getObject("/courses/101", nil, new(Course)); err != nil {
+		t.Errorf("expected the request to go through on the third try, got %v", err)
+	}
+	if gets := fake.requestsTo("GET", "/courses/101"); len(gets) != 3 {
+		t.Errorf("expected 3 tries, got %d", len(gets))
+	}
+
+	// Canvas might have made the assignment before the error, so it's not
+	// tried again, but a throttled request was never processed
+	fake.failTimes("POST", "/courses/101/assignments", http.StatusInternalServerError, 1)
+	if err := client.postObject("/courses/101/assignments", nil, map[string]interface{}{}, new(Assignment)); err == nil {
+		t.Errorf("expected a failed POST not to be retried")
+	}
+	fake.failTimes("POST", "/courses/101/assignments", http.StatusTooManyRequests, 1)
+	if err := client.postObject("/courses/101/assignments", nil, map[string]interface{}{}, new(Assignment)); err != nil {
+		t.Errorf("expected a throttled POST to be retried, got %v", err)
+	}
+	if posts := fake.requestsTo("POST", "/courses/101/assignments"); len(posts) != 3 {
+		t.Errorf("expected 3 POSTs, got %d", len(posts))
+	}
+
+	fake.failWith("GET", "/courses/101/pages/broken", http.StatusBadGateway)
+	err := client.getObject("/courses/101/pages/broken", nil, new(Page))
+	if canvasErr, ok := err.(*CanvasError); !ok || canvasErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the last error once out of retries, got %v", err)
+	}
+	if gets := fake.requestsTo("GET", "/courses/101/pages/broken"); len(gets) != 4 {
+		t.Errorf("expected 1 try and 3 retries, got %d", len(gets))
+	}
+}
+
+func TestRejectedOAuthTokenIsRefreshedOnce(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	client := NewCanvasClient(fake.server.URL, "")
+	client.OAuth = &oauthSource{host: fake.server.URL, clientId: "1", token: &oauthToken{AccessToken: "revoked", RefreshToken: "fake-refresh", ClientSecret: "fake-secret"}}
+
+	if err := client.getObject("/courses/101", nil, new(Course)); err != nil {
+		t.Fatalf("expected the request to go through with a refreshed token, got %v", err)
+	}
+	if refreshes := fake.requestsTo("POST", oauthTokenPath); len(refreshes) != 1 {
+		t.Errorf("expected one refresh, got %v", refreshes)
+	}
+
+	// a token that's still rejected after refreshing isn't refreshed again
+	fake.failWith("GET", "/courses/101", http.StatusUnauthorized)
+	err := client.getObject("/courses/101", nil, new(Course))
+	if canvasErr, ok := err.(*CanvasError); !ok || canvasErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+	if refreshes := fake.requestsTo("POST", oauthTokenPath); len(refreshes) != 2 {
+		t.Errorf("expected one more refresh, got %d in all", len(refreshes))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 8; attempt++ {
+		longest := retryBaseDelay << uint(attempt)
+		if longest > 5*time.Second {
+			longest = 5 * time.Second
+		}
+		for i := 0; i < 20; i++ {
+			if delay := backoff(attempt, nil, 5*time.Second); delay < longest/2 || delay > longest {
+				t.Fatalf("expected attempt %d to wait between %v and %v, got %v", attempt, longest/2, longest, delay)
+			}
+		}
+	}
+
+	throttled := &http.Response{Header: http.Header{"Retry-After": []string{"3"}}}
+	if delay := backoff(0, throttled, 10*time.Second); delay != 3*time.Second {
+		t.Errorf("expected Retry-After to be honored, got %v", delay)
+	}
+	if delay := backoff(0, throttled, time.Second); delay != time.Second {
+		t.Errorf("expected the wait to be capped, got %v", delay)
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := make(chan string)
+	go func() {
+		raw, _ := ioutil.ReadAll(r)
+		printed <- string(raw)
+	}()
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	f()
+	w.Close()
+	return <-printed
+}
+
+func TestRunJobsInOrder(t *testing.T) {
+	defer func(jobs int) { Config.jobs = jobs }(Config.jobs)
+	Config.jobs, Config.dryRun = 4, false
+
+	var running, most int32
+	done := []int{}
+	output := captureStdout(t, func() {
+		err := runJobs(8, func(i int, out io.Writer) error {
+			n := atomic.AddInt32(&running, 1)
+			for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+			}
+			// the later jobs finish first
+			time.Sleep(time.Duration(8-i) * 5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			fmt.Fprintf(out, "job %d\n", i)
+			return nil
+		}, func(i int, err error) error {
+			done = append(done, i)
+			return err
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if output != "job 0\njob 1\njob 2\njob 3\njob 4\njob 5\njob 6\njob 7\n" || fmt.Sprint(done) != "[0 1 2 3 4 5 6 7]" {
+		t.Errorf("expected the output and results in order, got %q and %v", output, done)
+	}
+	if most < 2 {
+		t.Errorf("expected jobs to run at the same time, got at most %d", most)
+	}
+
+	// once done fails, no more jobs are started
+	var started int32
+	stop := errors.New("stop")
+	captureStdout(t, func() {
+		err := runJobs(100, func(i int, out io.Writer) error {
+			atomic.AddInt32(&started, 1)
+			time.Sleep(time.Millisecond)
+			return nil
+		}, func(i int, err error) error {
+			return stop
+		})
+		if err != stop {
+			t.Errorf("expected done's error, got %v", err)
+		}
+	})
+	if started > 10 {
+		t.Errorf("expected jobs to stop being started, but %d were", started)
+	}
+}
+
+func TestLoginLeavesOldDbAlone(t *testing.T) {
+	fake := newFakeCanvas(t)
+	setupEasel(t, fake)
+
+	// make the db look like it's from before profiles could be pinned
+	db, err := sql.Open("sqlite3", easelDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{"DROP TABLE settings", "DELETE FROM " + schemaVersionTable + " WHERE version >= 5"} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	CommandLogin(nil, []string{fake.server.URL, fakeToken})
+	if name, source := activeProfile(mustReadRc()); name != defaultProfile || source != perUserDotFile {
+		t.Errorf("expected nothing to be pinned, got %s from %s", name, source)
+	}
+	var version int
+	if err := db.QueryRow("SELECT MAX(version) FROM " + schemaVersionTable).Scan(&version); err != nil || version != 4 {
+		t.Errorf("expected the db not to be upgraded, got version %d (%v)", version, err)
+	}
+}
+
+func TestMatchingQuestionPayloadKeepsDistractors(t *testing.T) {
+	qq := &QuizQuestion{
+		QuestionType: "matching_question",
+		Answers: []map[string]interface{}{
+			{"id": 1, "left": "dog", "right": "bark", "match_id": 11},
+			{"id": 2, "left": "cat", "right": "meow", "match_id": 12},
+		},
+		Matches: []map[string]interface{}{
+			{"match_id": 11, "text": "bark"}, {"match_id": 12, "text": "meow"}, {"match_id": 13, "text": "moo"}, {"match_id": 14, "text": "quack"},
+		},
+	}
+	payload := qq.payload(1)
+	if incorrect := payload["matching_answer_incorrect_matches"]; incorrect != "moo\nquack" {
+		t.Errorf("expected the matches that don't go with an answer, got %q", incorrect)
+	}
+	if answer := payload["answers"].([]map[string]interface{})[0]; answer["answer_match_left"] != "dog" || answer["answer_match_right"] != "bark" {
+		t.Errorf("expected the answers in the form Canvas takes them, got %v", answer)
+	}
+}
+
+func TestPushModuleLeavesExternalToolsToCanvas(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	moduleId := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	fake.add(fmt.Sprintf("/courses/101/modules/%d/items", moduleId), map[string]interface{}{
+		"title": "Textbook", "type": "ExternalTool", "content_id": 77, "external_url": "https://tool.example.com/launch", "position": 1,
+	})
+	setupEasel(t, fake, 101, 102)
+	CommandPull(nil, []string{"modules"})
+
+	db, courses := openTestDb(t)
+	if err := pushAll(t, db, courses, "modules"); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || !strings.Contains(failures[0].err.Error(), "add it in Canvas first") {
+		t.Errorf("expected the tool to have to be added in course 102 by hand, got %v", failures)
+	}
+	failures = nil
+	if posts := fake.requestsTo("POST", "/courses/102/modules/"); len(posts) != 0 {
+		t.Errorf("expected no items to be created without a tool id, got %v", posts)
+	}
+	if puts := fake.requestsTo("PUT", fmt.Sprintf("/courses/101/modules/%d/items/", moduleId)); len(puts) != 1 {
+		t.Errorf("expected the tool to still be updated where it exists, got %v", puts)
+	}
+}
+
+func TestPruneKeepsRenamedAndSubmittedComponents(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "")
+	for _, course := range []string{"/courses/101", "/courses/102"} {
+		fake.add(course+"/assignments", map[string]interface{}{"name": "Lab 1"})
+	}
+	graded := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Old Lab", "has_submitted_submissions": true})
+	quizId := fake.add("/courses/101/quizzes", map[string]interface{}{"title": "Old Quiz"})
+	fake.add(fmt.Sprintf("/courses/101/quizzes/%d/submissions", quizId), map[string]interface{}{"quiz_id": quizId})
+	setupEasel(t, fake, 101, 102)
+	CommandPull(nil, []string{"assignments"})
+	CommandPull(nil, []string{"quizzes"})
+
+	// rename Lab 1, which gives it a new file, and delete the graded ones
+	lab := readTestFile(t, "assignments/lab-1.md")
+	writeTestFile(t, "assignments/lab-one.md", strings.Replace(lab, "name: Lab 1", "name: Lab One", 1))
+	for _, path := range []string{"assignments/lab-1.md", "assignments/old-lab.md", "quizzes/old-quiz.md"} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Config.yes = true
+	db, courses := openTestDb(t)
+	if err := pruneComponents(newClient(), db, courses, componentKinds); err != nil {
+		t.Fatal(err)
+	}
+	if deletes := fake.requestsTo("DELETE", "/"); len(deletes) != 0 {
+		t.Errorf("expected nothing to be deleted, got %v", deletes)
+	}
+	if len(failures) != 2 || !strings.Contains(failures[0].err.Error(), "--force") {
+		t.Errorf("expected the graded assignment and quiz to be kept for having submissions, got %v", failures)
+	}
+	failures = nil
+
+	Config.force = true
+	if err := pruneComponents(newClient(), db, courses, componentKinds); err != nil {
+		t.Fatal(err)
+	}
+	deleted := []string{}
+	for _, req := range fake.requestsTo("DELETE", "/") {
+		deleted = append(deleted, req.Path)
+	}
+	expected := []string{fmt.Sprintf("/courses/101/quizzes/%d", quizId), fmt.Sprintf("/courses/101/assignments/%d", graded)}
+	if strings.Join(deleted, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected only %v to be deleted with --force, got %v", expected, deleted)
+	}
+}
+
+func TestPushPruneTakesSingularTypeNames(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "old-lesson", "title": "Old lesson", "body": "<p>Hi</p>"})
+	oldLab := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Old Lab"})
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"pages"})
+	CommandPull(nil, []string{"assignments"})
+	for _, path := range []string{"pages/old-lesson.md", "assignments/old-lab.md"} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Config.prune, Config.yes = true, true
+	CommandPush(nil, []string{"assignment"})
+	deletes := fake.requestsTo("DELETE", "/")
+	if len(deletes) != 1 || deletes[0].Path != fmt.Sprintf("/courses/101/assignments/%d", oldLab) {
+		t.Errorf("expected only the old lab to be pruned, got %v", deletes)
+	}
+}
+
+func TestCourseAddKeepsTheLocalSyllabus(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "<p>Welcome to section 1</p>")
+	fake.addCourse(102, "CS 1400-02 Fundamentals", "<p>Welcome to section 2</p>")
+	setupEasel(t, fake, 101, 102)
+
+	if syllabus := readTestFile(t, syllabusFile); !strings.Contains(syllabus, "section 1") {
+		t.Errorf("expected adding section 102 to leave the syllabus alone, got %q", syllabus)
+	}
+	db, courses := openTestDb(t)
+	for _, course := range courses {
+		status, err := syllabusStatus(newClient(), db, course)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.status != statusInSync {
+			t.Errorf("expected the syllabus to be in sync with %s right after adding it, got %s", course.Name, status.status)
+		}
+	}
+}
+
+func TestDiffComparesModuleItems(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	moduleId := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	itemsPath := fmt.Sprintf("/courses/101/modules/%d/items", moduleId)
+	for i, title := range []string{"Start here", "Wrap up"} {
+		fake.add(itemsPath, map[string]interface{}{"title": title, "type": "SubHeader", "position": i + 1})
+	}
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"modules"})
+
+	kind, _ := findComponentKind("modules")
+	path := (&Module{Name: "Week 1"}).Filepath()
+	diffModule := func() string {
+		local, err := kind.load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, courses := openTestDb(t)
+		diff, err := diffComponent(newClient(), db, courses[0], true, kind, local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diff
+	}
+	if diff := diffModule(); diff != "" {
+		t.Errorf("expected the items in Canvas to match the pulled ones, got\n%s", diff)
+	}
+
+	writeTestFile(t, path, strings.Replace(readTestFile(t, path), "Wrap up", "Wrap it up", 1))
+	if diff := diffModule(); !strings.Contains(diff, "-  title: Wrap up") || !strings.Contains(diff, "+  title: Wrap it up") || strings.Contains(diff, "Start here") {
+		t.Errorf("expected only the renamed item to differ, got\n%s", diff)
+	}
+}
+
+func TestDiffIsEmptyRightAfterPull(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	teams := fake.add("/courses/101/group_categories", map[string]interface{}{"name": "Teams"})
+	labs := fake.add("/courses/101/assignment_groups", map[string]interface{}{"name": "Labs"})
+	lab1 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1", "assignment_group_id": labs})
+	graded := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Design review", "points_possible": 10, "assignment_group_id": labs})
+	fake.add("/courses/101/discussion_topics", map[string]interface{}{
+		"title": "Design review", "message": "<p>Post your design</p>", "assignment_id": graded, "group_category_id": teams,
+	})
+	moduleId := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	itemsPath := fmt.Sprintf("/courses/101/modules/%d/items", moduleId)
+	fake.add(itemsPath, map[string]interface{}{"title": "Start here", "type": "SubHeader", "position": 1})
+	fake.add(itemsPath, map[string]interface{}{"title": "Lab 1", "type": "Assignment", "content_id": lab1, "position": 2})
+	setupEasel(t, fake, 101)
+	kinds := []string{"assignment_groups", "assignments", "discussions", "modules"}
+	for _, kind := range kinds {
+		CommandPull(nil, []string{kind})
+	}
+
+	db, courses := openTestDb(t)
+	for _, name := range kinds {
+		kind, _ := findComponentKind(name)
+		components, err := kind.loadComponents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(components) == 0 {
+			t.Errorf("expected some %s to be pulled", name)
+		}
+		for _, component := range components {
+			diff, err := diffComponent(newClient(), db, courses[0], true, kind, component)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff != "" {
+				t.Errorf("expected no differences right after a pull, got\n%s", diff)
+			}
+		}
+	}
+}
+
+func TestModuleItemsLinkToRenamedComponentsByLocalName(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	lab1 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1"})
+	moduleId := fake.add("/courses/101/modules", map[string]interface{}{"name": "Week 1", "position": 1})
+	itemsPath := fmt.Sprintf("/courses/101/modules/%d/items", moduleId)
+	itemId := fake.add(itemsPath, map[string]interface{}{"title": "Lab 1", "type": "Assignment", "content_id": lab1, "position": 1})
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"assignments"})
+
+	// renamed in Canvas, but still lab-1 locally
+	fake.find("/courses/101/assignments", strconv.Itoa(lab1))["name"] = "Lab One"
+	fake.find(itemsPath, strconv.Itoa(itemId))["title"] = "Lab One"
+	CommandPull(nil, []string{"modules"})
+
+	path := (&Module{Name: "Week 1"}).Filepath()
+	if module := readTestFile(t, path); !strings.Contains(module, "assignment: lab-1") {
+		t.Errorf("expected the item to link to the local lab-1, got %q", module)
+	}
+	db, courses := openTestDb(t)
+	if err := pushAll(t, db, courses, "modules"); err != nil || len(failures) != 0 {
+		t.Errorf("expected the module to push, got %v %v", err, failures)
+	}
+}
+
+func TestPushRecreatesComponentsDeletedInCanvas(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	lab1 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 1"})
+	lab2 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 2"})
+	quizId := fake.add("/courses/101/quizzes", map[string]interface{}{"title": "Quiz 1"})
+	fake.add(fmt.Sprintf("/courses/101/quizzes/%d/questions", quizId), map[string]interface{}{
+		"quiz_id": quizId, "question_name": "Q1", "question_type": "essay_question", "question_text": "<p>Why?</p>",
+	})
+	setupEasel(t, fake, 101)
+	CommandPull(nil, []string{"assignments"})
+	CommandPull(nil, []string{"quizzes"})
+
+	// lab 1 and the quiz are gone for good, and lab 2 was deleted and made again
+	fake.drop("/courses/101/assignments", strconv.Itoa(lab1))
+	fake.drop("/courses/101/assignments", strconv.Itoa(lab2))
+	fake.drop("/courses/101/quizzes", strconv.Itoa(quizId))
+	newLab2 := fake.add("/courses/101/assignments", map[string]interface{}{"name": "Lab 2"})
+
+	db, courses := openTestDb(t)
+	for _, kind := range []string{"assignments", "quizzes"} {
+		if err := pushAll(t, db, courses, kind); err != nil || len(failures) != 0 {
+			t.Fatalf("expected components deleted in Canvas to be pushed again, got %v %v", err, failures)
+		}
+	}
+	if posts := fake.requestsTo("POST", "/courses/101/assignments"); len(posts) != 1 || posts[0].Body["assignment"].(map[string]interface{})["name"] != "Lab 1" {
+		t.Errorf("expected lab 1 to be created again, got %v", posts)
+	}
+	if puts := fake.requestsTo("PUT", fmt.Sprintf("/courses/101/assignments/%d", newLab2)); len(puts) != 1 {
+		t.Errorf("expected the new lab 2 to be found by name and updated, got %v", puts)
+	}
+	newQuizId, _ := findCanvasId(db, "quiz", "quiz-1", courses[0])
+	if posts := fake.requestsTo("POST", fmt.Sprintf("/courses/101/quizzes/%d/questions", newQuizId)); newQuizId == 0 || len(posts) != 1 {
+		t.Errorf("expected the quiz and its question to be created again, got %v", posts)
+	}
+
+	// the new ids are the ones recorded now
+	for _, c := range []struct {
+		componentType, id string
+		stale             int
+	}{{"assignment", "lab-1", lab1}, {"assignment", "lab-2", lab2}, {"quiz", "quiz-1", quizId}} {
+		canvasId, err := findCanvasId(db, c.componentType, c.id, courses[0])
+		if err != nil || canvasId == 0 || canvasId == c.stale {
+			t.Errorf("expected a new id to be recorded for %s %s, got %d %v", c.componentType, c.id, canvasId, err)
+		}
+	}
+}
+
+func TestPullTakesSingularTypeNames(t *testing.T) {
+	fake := newFakeCanvas(t)
+	fake.addCourse(101, "CS 1400-01 Fundamentals", "")
+	fake.add("/courses/101/pages", map[string]interface{}{"url": "intro", "title": "Intro", "body": "<p>Hi</p>"})
+	fake.add("/courses/101/discussion_topics", map[string]interface{}{"title": "Introductions", "message": "<p>Say hi</p>"})
+	setupEasel(t, fake, 101)
+
+	CommandPull(nil, []string{"page"})
+	CommandPull(nil, []string{"discussion"})
+	for _, path := range []string{filepath.Join(pagesDir, "intro.md"), (&DiscussionTopic{Title: "Introductions"}).Filepath()} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be pulled: %v", path, err)
+		}
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"path/filepath"
 )
@@ -21,35 +21,48 @@ type ExternalTool struct {
 	ConfigUrl    string `json:"config_url" yaml:"config_url"`
 }
 
-func pushExternalTool(db *sql.DB, filename string) {
+func pushExternalTool(client *CanvasClient, db *sql.DB, courses []*Course, filename string, out io.Writer) error {
 	et := new(ExternalTool)
 	// read yaml
 	err := readYamlFile(filename, et)
 	if err != nil {
-		log.Fatalf("Failed to read yaml file %s: %v\n", filename, err)
+		return fmt.Errorf("failed to read yaml file %s: %v", filename, err)
 	}
-	et.Push(db)
+	return et.Push(client, db, courses, out)
 }
 
-func pushExternalTools(db *sql.DB) {
+// pushExternalTools pushes every local external tool, carrying on past the
+// ones that fail.
+func pushExternalTools(client *CanvasClient, db *sql.DB, courses []*Course) error {
 	files, err := ioutil.ReadDir(externalToolsDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	filenames := make([]string, 0, len(files))
 	for _, f := range files {
 		fullPath := fmt.Sprintf("%s/%s", externalToolsDir, f.Name())
 		if filepath.Ext(fullPath) == ".yaml" {
-			pushExternalTool(db, fullPath)
+			filenames = append(filenames, fullPath)
 		}
 	}
+	return runJobs(len(filenames), func(i int, out io.Writer) error {
+		return pushExternalTool(client, db, courses, filenames[i], out)
+	}, func(i int, err error) error {
+		if err != nil {
+			recordFailure("push external tool "+filenames[i], err)
+		}
+		return nil
+	})
 }
 
-func (et *ExternalTool) Push(db *sql.DB) {
-	courses, _ := findCourses(db)
+func (et *ExternalTool) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
 	for _, course := range courses {
 		etFullPath := fmt.Sprintf(externalToolsPath, course.CanvasId)
-		fmt.Printf("Pushing %T %s\n", et, et.Name)
-		mustPostObject(etFullPath, url.Values{}, et, nil)
+		fmt.Fprintf(out, "Pushing %T %s\n", et, et.Name)
+		if err := client.postObject(etFullPath, url.Values{}, et, nil); err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// A component that couldn't be synced. Failures are collected over the whole
+// run so one bad component doesn't stop the rest, and reported at the end.
+type failure struct {
+	item string
+	err  error
+}
+
+var failures []failure
+
+// recordFailure notes that the given item failed and carries on.
+func recordFailure(item string, err error) {
+	log.Printf("Failed to %s: %v", item, err)
+	failures = append(failures, failure{item, err})
+}
+
+// reportFailures lists everything that failed during the run, if anything did,
+// and exits with a nonzero status.
+func reportFailures() {
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Printf("\n%d failed:\n", len(failures))
+	for _, f := range failures {
+		fmt.Printf("  %s: %v\n", f.item, f.err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeToken = "fake-token"
+
+// fakeCanvas is an in-process stand-in for the parts of the Canvas API easel
+// uses. Objects are kept as plain json maps, grouped by the api path that lists
+// them, e.g., /courses/101/pages. Every request is recorded so tests can check
+// what easel sent.
+type fakeCanvas struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	nextId   int
+	courses  map[int]map[string]interface{}
+	lists    map[string][]map[string]interface{}
+	requests []fakeRequest
+	// the access tokens that are accepted
+	tokens map[string]bool
+	// the most items returned in one page, whatever per_page asks for, so
+	// tests can exercise pagination without making lots of objects
+	pageSize int
+	// canned error responses by method and path, e.g., "PUT /courses/101/pages/x"
+	failures map[string]int
+	// how many more times each canned error is sent before requests go through
+	// again; errors that aren't counted are sent every time
+	failuresLeft map[string]int
+}
+
+type fakeRequest struct {
+	Method string
+	Path   string // without the /api/v1 prefix
+	Query  url.Values
+	Form   url.Values // for the OAuth endpoints, which take forms instead of json
+	Body   map[string]interface{}
+}
+
+var (
+	fakeCoursePath = regexp.MustCompile(`^/courses/(\d+)$`)
+	fakeListPath   = regexp.MustCompile(`^/courses/\d+/(pages|assignments|assignment_groups|modules|quizzes|discussion_topics|external_tools|group_categories)$`)
+	fakeItemPath   = regexp.MustCompile(`^(/courses/\d+/(pages|assignments|assignment_groups|modules|quizzes|discussion_topics))/([^/]+)$`)
+	// group sets are fetched by id without the course
+	fakeGroupCategoryPath = regexp.MustCompile(`^/group_categories/(\d+)$`)
+	// the parts of a component that live under it, i.e., quiz questions and
+	// module items
+	fakePartsPath   = regexp.MustCompile(`^/courses/\d+/(quizzes/\d+/questions|modules/\d+/items)$`)
+	fakePartPath    = regexp.MustCompile(`^(/courses/\d+/(quizzes/\d+/questions|modules/\d+/items))/(\d+)$`)
+	fakeReorderPath = regexp.MustCompile(`^(/courses/\d+/quizzes/\d+)/reorder$`)
+	// quiz submissions are listed wrapped in an object, unlike everything else
+	fakeSubmissionsPath = regexp.MustCompile(`^/courses/\d+/quizzes/\d+/submissions$`)
+)
+
+// the key each kind of object is wrapped in when it's created or updated
+var fakeWrappers = map[string]string{
+	"pages":       "wiki_page",
+	"assignments": "assignment",
+	"quizzes":     "quiz",
+	"modules":     "module",
+	"questions":   "question",
+	"items":       "module_item",
+}
+
+func newFakeCanvas(t *testing.T) *fakeCanvas {
+	fake := &fakeCanvas{
+		t:            t,
+		nextId:       1000,
+		courses:      make(map[int]map[string]interface{}),
+		lists:        make(map[string][]map[string]interface{}),
+		pageSize:     100,
+		failures:     make(map[string]int),
+		failuresLeft: make(map[string]int),
+		tokens:       map[string]bool{fakeToken: true},
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+// addCourse adds a course with the given syllabus.
+func (fake *fakeCanvas) addCourse(id int, name, syllabus string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.courses[id] = map[string]interface{}{
+		"id":             id,
+		"name":           name,
+		"course_code":    strings.Fields(name)[0],
+		"syllabus_body":  syllabus,
+		"workflow_state": "available",
+	}
+}
+
+// add adds an object to the listing at the given path, giving it an id if it
+// doesn't have one. Returns the id.
+func (fake *fakeCanvas) add(path string, object map[string]interface{}) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := object["id"]; !ok {
+		object["id"] = fake.newId()
+	}
+	if _, ok := object["updated_at"]; !ok {
+		object["updated_at"] = "2020-01-01T00:00:00Z"
+	}
+	fake.lists[path] = append(fake.lists[path], object)
+	return int(toFloat(object["id"]))
+}
+
+// find returns the object in the listing at the given path with the given key,
+// which is the url for pages and the id for everything else.
+func (fake *fakeCanvas) find(path, key string) map[string]interface{} {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.lookup(path, key)
+}
+
+// drop deletes the object like someone deleting it in Canvas would.
+func (fake *fakeCanvas) drop(path, key string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.remove(path, key)
+}
+
+// failWith makes every request with the given method and path fail with the
+// given status.
+func (fake *fakeCanvas) failWith(method, path string, status int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.failures[method+" "+path] = status
+}
+
+// failTimes makes the next few requests with the given method and path fail
+// with the given status, after which they succeed.
+func (fake *fakeCanvas) failTimes(method, path string, status, times int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.failures[method+" "+path] = status
+	fake.failuresLeft[method+" "+path] = times
+}
+
+// revoke stops the given access token from being accepted.
+func (fake *fakeCanvas) revoke(token string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	delete(fake.tokens, token)
+}
+
+// requestsTo returns the recorded requests with the given method whose path
+// starts with the given prefix.
+func (fake *fakeCanvas) requestsTo(method, prefix string) []fakeRequest {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	matching := []fakeRequest{}
+	for _, req := range fake.requests {
+		if req.Method == method && strings.HasPrefix(req.Path, prefix) {
+			matching = append(matching, req)
+		}
+	}
+	return matching
+}
+
+func (fake *fakeCanvas) newId() int {
+	fake.nextId++
+	return fake.nextId
+}
+
+func (fake *fakeCanvas) remove(path, key string) {
+	kept := []map[string]interface{}{}
+	for _, object := range fake.lists[path] {
+		if fakeKey(path, object) != key {
+			kept = append(kept, object)
+		}
+	}
+	fake.lists[path] = kept
+}
+
+// place moves a module item to the position it was given, like Canvas does.
+// Quiz questions are put in order by reordering them instead.
+func (fake *fakeCanvas) place(path string, object map[string]interface{}) {
+	position := int(toFloat(object["position"]))
+	if !strings.HasSuffix(path, "/items") || position < 1 {
+		return
+	}
+	key := fakeKey(path, object)
+	fake.remove(path, key)
+	objects := fake.lists[path]
+	if position > len(objects)+1 {
+		position = len(objects) + 1
+	}
+	placed := append([]map[string]interface{}{}, objects[:position-1]...)
+	placed = append(placed, object)
+	fake.lists[path] = append(placed, objects[position-1:]...)
+	for i, o := range fake.lists[path] {
+		o["position"] = i + 1
+	}
+}
+
+// hasParent reports whether the quiz or module that the parts at the given
+// path belong to still exists.
+func (fake *fakeCanvas) hasParent(path string) bool {
+	parent := path[:strings.LastIndex(path, "/")]
+	i := strings.LastIndex(parent, "/")
+	return fake.lookup(parent[:i], parent[i+1:]) != nil
+}
+
+func (fake *fakeCanvas) lookup(path, key string) map[string]interface{} {
+	for _, object := range fake.lists[path] {
+		if fakeKey(path, object) == key {
+			return object
+		}
+	}
+	return nil
+}
+
+// fakeKey returns what identifies the object in api paths: the url for pages
+// and the id for everything else.
+func fakeKey(path string, object map[string]interface{}) string {
+	if strings.HasSuffix(path, "/pages") {
+		url, _ := object["url"].(string)
+		return url
+	}
+	return strconv.Itoa(int(toFloat(object["id"])))
+}
+
+func (fake *fakeCanvas) serve(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, urlPrefix)
+	req := fakeRequest{Method: r.Method, Path: path, Query: r.URL.Query()}
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		r.ParseForm()
+		req.Form = r.PostForm
+	} else if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req.Body)
+	}
+	fake.requests = append(fake.requests, req)
+
+	if strings.HasPrefix(path, "/login/oauth2/") {
+		fake.oauth(w, r, req)
+		return
+	}
+	if !fake.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		fake.fail(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+	if status, ok := fake.failures[r.Method+" "+path]; ok {
+		if left, counted := fake.failuresLeft[r.Method+" "+path]; counted {
+			fake.failuresLeft[r.Method+" "+path] = left - 1
+			if left <= 1 {
+				delete(fake.failures, r.Method+" "+path)
+				delete(fake.failuresLeft, r.Method+" "+path)
+			}
+		}
+		fake.fail(w, status, "Something went wrong.")
+		return
+	}
+
+	switch {
+	case path == selfPath && r.Method == "GET":
+		fake.reply(w, http.StatusOK, map[string]interface{}{"id": 1, "name": "Test Instructor", "login_id": "instructor"})
+
+	case fakeCoursePath.MatchString(path):
+		id, _ := strconv.Atoi(fakeCoursePath.FindStringSubmatch(path)[1])
+		course, ok := fake.courses[id]
+		if !ok {
+			fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+			return
+		}
+		if r.Method == "PUT" {
+			updateFields(course, req.Body["course"])
+		}
+		fake.reply(w, http.StatusOK, course)
+
+	case fakeListPath.MatchString(path) && r.Method == "GET":
+		fake.list(w, r, path)
+
+	case fakeListPath.MatchString(path) && r.Method == "POST":
+		kind := fakeListPath.FindStringSubmatch(path)[1]
+		object := map[string]interface{}{"id": fake.newId()}
+		if wrapper, ok := fakeWrappers[kind]; ok {
+			updateFields(object, req.Body[wrapper])
+		} else {
+			updateFields(object, req.Body)
+		}
+		fake.touch(object)
+		fake.lists[path] = append(fake.lists[path], object)
+		fake.reply(w, http.StatusCreated, object)
+
+	case fakePartsPath.MatchString(path) && !fake.hasParent(path):
+		fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+
+	case fakePartsPath.MatchString(path) && r.Method == "GET":
+		fake.list(w, r, path)
+
+	case fakePartsPath.MatchString(path) && r.Method == "POST":
+		object := map[string]interface{}{"id": fake.newId()}
+		updateFields(object, req.Body[fakeWrappers[lastSegment(path)]])
+		fake.lists[path] = append(fake.lists[path], object)
+		fake.place(path, object)
+		fake.reply(w, http.StatusOK, object)
+
+	case fakePartPath.MatchString(path):
+		groups := fakePartPath.FindStringSubmatch(path)
+		listPath, key := groups[1], groups[3]
+		object := fake.lookup(listPath, key)
+		if object == nil {
+			fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			updateFields(object, req.Body[fakeWrappers[lastSegment(listPath)]])
+			fake.place(listPath, object)
+		case "DELETE":
+			fake.remove(listPath, key)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fake.reply(w, http.StatusOK, object)
+
+	case fakeReorderPath.MatchString(path) && r.Method == "POST":
+		// put the questions in the order given, like Canvas does
+		listPath := fakeReorderPath.FindStringSubmatch(path)[1] + "/questions"
+		order, _ := req.Body["order"].([]interface{})
+		reordered := []map[string]interface{}{}
+		for i, item := range order {
+			id := strconv.Itoa(int(toFloat(item.(map[string]interface{})["id"])))
+			if object := fake.lookup(listPath, id); object != nil {
+				object["position"] = i + 1
+				reordered = append(reordered, object)
+			}
+		}
+		fake.lists[listPath] = reordered
+		w.WriteHeader(http.StatusNoContent)
+
+	case fakeItemPath.MatchString(path) && (r.Method == "GET" || r.Method == "PUT"):
+		groups := fakeItemPath.FindStringSubmatch(path)
+		listPath, kind, key := groups[1], groups[2], groups[3]
+		object := fake.lookup(listPath, key)
+		if object == nil && r.Method == "PUT" && kind == "pages" {
+			// putting a page that doesn't exist creates it
+			object = map[string]interface{}{"url": key, "page_id": fake.newId()}
+			fake.lists[listPath] = append(fake.lists[listPath], object)
+		}
+		if object == nil {
+			fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+			return
+		}
+		if r.Method == "PUT" {
+			if wrapper, ok := fakeWrappers[kind]; ok {
+				updateFields(object, req.Body[wrapper])
+			} else {
+				updateFields(object, req.Body)
+			}
+			fake.touch(object)
+		}
+		fake.reply(w, http.StatusOK, object)
+
+	case fakeSubmissionsPath.MatchString(path) && r.Method == "GET":
+		submissions := fake.lists[path]
+		if submissions == nil {
+			submissions = []map[string]interface{}{}
+		}
+		fake.reply(w, http.StatusOK, map[string]interface{}{"quiz_submissions": submissions})
+
+	case fakeGroupCategoryPath.MatchString(path) && r.Method == "GET":
+		key := fakeGroupCategoryPath.FindStringSubmatch(path)[1]
+		for listPath := range fake.lists {
+			if strings.HasSuffix(listPath, "/group_categories") {
+				if object := fake.lookup(listPath, key); object != nil {
+					fake.reply(w, http.StatusOK, object)
+					return
+				}
+			}
+		}
+		fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+
+	case fakeItemPath.MatchString(path) && r.Method == "DELETE":
+		groups := fakeItemPath.FindStringSubmatch(path)
+		listPath, key := groups[1], groups[3]
+		object := fake.lookup(listPath, key)
+		if object == nil {
+			fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+			return
+		}
+		fake.remove(listPath, key)
+		fake.reply(w, http.StatusOK, object)
+
+	default:
+		fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+	}
+}
+
+// oauth plays both Canvas and the user in the OAuth flow: the user approves
+// every authorization request, and every code and refresh token is good for a
+// new access token.
+func (fake *fakeCanvas) oauth(w http.ResponseWriter, r *http.Request, req fakeRequest) {
+	switch {
+	case req.Path == oauthAuthPath:
+		redirect, err := url.Parse(req.Query.Get("redirect_uri"))
+		if err != nil {
+			fake.fail(w, http.StatusBadRequest, "Bad redirect_uri.")
+			return
+		}
+		query := url.Values{}
+		query.Set("code", fmt.Sprintf("code-%d", fake.newId()))
+		query.Set("state", req.Query.Get("state"))
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+
+	case req.Path == oauthTokenPath && r.Method == "POST":
+		if req.Form.Get("client_secret") != "fake-secret" {
+			fake.reply(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		token := fmt.Sprintf("fake-access-%d", fake.newId())
+		fake.tokens[token] = true
+		reply := map[string]interface{}{"access_token": token, "token_type": "Bearer", "expires_in": 3600}
+		if req.Form.Get("grant_type") == "authorization_code" {
+			reply["refresh_token"] = "fake-refresh"
+		}
+		fake.reply(w, http.StatusOK, reply)
+
+	default:
+		fake.fail(w, http.StatusNotFound, "The specified resource does not exist.")
+	}
+}
+
+// list replies with a single page of a listing, linking to the next page if
+// there is one.
+func (fake *fakeCanvas) list(w http.ResponseWriter, r *http.Request, path string) {
+	query := r.URL.Query()
+	items := fake.lists[path]
+	if term := query.Get("search_term"); term != "" {
+		matching := []map[string]interface{}{}
+		for _, item := range items {
+			name, _ := item["name"].(string)
+			if title, ok := item["title"].(string); ok {
+				name = title
+			}
+			if strings.Contains(strings.ToLower(name), strings.ToLower(term)) {
+				matching = append(matching, item)
+			}
+		}
+		items = matching
+	}
+
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage > fake.pageSize {
+		perPage = fake.pageSize
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + perPage
+	if end >= len(items) {
+		end = len(items)
+	} else {
+		query.Set("page", strconv.Itoa(page+1))
+		next := fmt.Sprintf("%s%s?%s", fake.server.URL, r.URL.Path, query.Encode())
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+	}
+	if items == nil {
+		items = []map[string]interface{}{}
+	}
+	fake.reply(w, http.StatusOK, items[start:end])
+}
+
+// touch bumps the object's updated_at like Canvas does on every change.
+func (fake *fakeCanvas) touch(object map[string]interface{}) {
+	object["updated_at"] = time.Unix(int64(fake.newId()), 0).UTC().Format(time.RFC3339)
+}
+
+func (fake *fakeCanvas) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Rate-Limit-Remaining", "700.0")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		fake.t.Errorf("fake canvas failed to encode reply: %v", err)
+	}
+}
+
+// fail replies with an error in the shape Canvas uses.
+func (fake *fakeCanvas) fail(w http.ResponseWriter, status int, message string) {
+	fake.reply(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+// updateFields copies the fields sent by easel into the object.
+func updateFields(object map[string]interface{}, fields interface{}) {
+	updates, _ := fields.(map[string]interface{})
+	for key, value := range updates {
+		object[key] = value
+	}
+}
+
+func lastSegment(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -1,39 +1,121 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
-	"github.com/deiu/linkparser"
+	"github.com/russross/blackfriday"
 	"gopkg.in/yaml.v2"
 )
 
 const (
 	easelDb = ".easeldb"
+	// suffix of the files holding Canvas's version of a body that differs from
+	// the local markdown
+	canvasBodySuffix = ".canvas.html"
 )
 
-func writeFile(filename, metadata, html string) error {
-	text := html
-	if metadata != "" {
-		text = fmt.Sprintf("```\n%s```\n", metadata) + text
+var htmlWhitespace = regexp.MustCompile(`\s+`)
+
+func joinFile(metadata, body string) string {
+	if metadata == "" {
+		return body
+	}
+	return fmt.Sprintf("```\n%s```\n", metadata) + body
+}
+
+// splitFile splits a component file into its yaml metadata, which is fenced in
+// a code block at the very beginning, and its body.
+func splitFile(text string) (string, string) {
+	if !strings.HasPrefix(text, "```\n") {
+		return "", text
+	}
+	end := strings.Index(text[3:], "\n```\n")
+	if end < 0 {
+		return "", text
+	}
+	return text[4 : end+4], text[end+8:]
+}
+
+// isComponentFile reports whether a file in a component directory holds a
+// component, as opposed to something easel or an editor put there.
+func isComponentFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, canvasBodySuffix)
+}
+
+// isHtmlBody reports whether a local body is html, which means it came from
+// Canvas rather than being written in markdown.
+func isHtmlBody(body string) bool {
+	return strings.HasPrefix(strings.TrimSpace(body), "<")
+}
+
+// normalizeHtml smooths over formatting differences that don't change how html
+// displays, e.g., Canvas reflowing the html it's given.
+func normalizeHtml(html string) string {
+	html = htmlWhitespace.ReplaceAllString(html, " ")
+	html = strings.ReplaceAll(html, "> <", "><")
+	html = strings.ReplaceAll(html, " />", ">")
+	html = strings.ReplaceAll(html, "/>", ">")
+	return strings.TrimSpace(html)
+}
+
+// sameHtml reports whether two html fragments display the same.
+func sameHtml(a, b string) bool {
+	return normalizeHtml(a) == normalizeHtml(b)
+}
+
+// writeFile writes a component pulled from Canvas. Canvas stores bodies in html,
+// but they're written locally in markdown, and html can't be faithfully turned
+// back into markdown. So a local markdown body is never replaced: if it renders
+// to the same html Canvas has, only the metadata is updated. If it doesn't, the
+// metadata is still updated but Canvas's body is written next to the file for
+// review. Bodies that are already html are synced like any other file.
+func writeFile(db *sql.DB, filename, metadata, html string) error {
+	sideFile := strings.TrimSuffix(filename, filepath.Ext(filename)) + canvasBodySuffix
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, localBody := splitFile(string(contents))
+
+	if err != nil || isHtmlBody(localBody) || localBody == "" {
+		return syncFile(db, filename, joinFile(metadata, html))
+	}
+
+	if sameHtml(renderMarkdown(localBody), html) {
+		// any earlier differences have since been resolved
+		if err := os.Remove(sideFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		fmt.Printf("  %s differs from Canvas, see %s\n", filename, sideFile)
+		if err := ioutil.WriteFile(sideFile, []byte(html), 0644); err != nil {
+			return err
+		}
 	}
-	return ioutil.WriteFile(filename, []byte(text), 0644)
+	return syncFile(db, filename, joinFile(metadata, localBody))
 }
 
-func writeYamlFile(filename, data string) error {
-	return ioutil.WriteFile(filename, []byte(data), 0644)
+// renderMarkdown converts locally written markdown into the html Canvas stores.
+// Everything pushed to Canvas goes through here so comparisons with what's in
+// Canvas see exactly what a push would send.
+func renderMarkdown(markdown string) string {
+	return string(blackfriday.MarkdownCommon([]byte(markdown)))
+}
+
+func writeYamlFile(db *sql.DB, filename, data string) error {
+	return syncFile(db, filename, data)
 }
 
 func mustCreateDb() {
@@ -53,45 +135,69 @@ func mustCreateDb() {
 	}
 	defer db.Close()
 
-	// TODO: create all tables (execute .sql file)
-	mustCreateCoursesTable(db)
+	if err := migrateDb(db); err != nil {
+		log.Fatalf("Failed to create database: %v", err)
+	}
 }
 
-func findDb() *sql.DB {
+// findDbPath searches the current directory and then its parents for the db.
+func findDbPath() (string, error) {
 	directory, err := filepath.Abs(".")
 	if err != nil {
-		log.Fatalf("error finding directory: %v", err)
+		return "", fmt.Errorf("error finding directory: %v", err)
 	}
 
-	dbName := easelDb
-	stepDir := directory
 	for {
-		path := filepath.Join(directory, dbName)
+		path := filepath.Join(directory, easelDb)
 		_, err := os.Stat(path)
 		if err == nil {
-			break
+			return path, nil
 		}
 		if !os.IsNotExist(err) {
-			log.Fatalf("error searching for %s in %s: %v", dbName, directory, err)
+			return "", fmt.Errorf("error searching for %s in %s: %v", easelDb, directory, err)
 		}
 
 		// try moving up a directory
-		stepDir = directory
+		stepDir := directory
 		directory = filepath.Dir(directory)
 		if directory == stepDir {
-			log.Fatal("No database found.")
+			return "", errNoDb
 		}
 	}
+}
 
-	dbName = directory + "/" + dbName
-	db, err := sql.Open("sqlite3", dbName)
+var errNoDb = errors.New("No database found.")
+
+func findDb() *sql.DB {
+	path, err := findDbPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := openDb(path)
 	if err != nil {
 		log.Fatal(err)
 	}
-
 	return db
 }
 
+func openDb(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only allows one writer at a time, so concurrent jobs share a
+	// single connection rather than failing with "database is locked"
+	db.SetMaxOpenConns(1)
+
+	// upgrade databases created by older versions
+	if err := migrateDb(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to upgrade database: %v", err)
+	}
+	return db, nil
+}
+
 func addWhereLike(where string, args []interface{}, label string, value string) (string, []interface{}) {
 	if where == "" {
 		where = " WHERE"
@@ -105,159 +211,76 @@ func addWhereLike(where string, args []interface{}, label string, value string)
 	return where, args
 }
 
-func mustGetObject(path string, params url.Values, download interface{}) {
-	doRequest(path, params, "GET", nil, download, false)
+// CanvasError is an error response from the Canvas API.
+type CanvasError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Messages   []string // the error messages Canvas sent back, if any
 }
 
-func getObject(path string, params url.Values, download interface{}) bool {
-	return doRequest(path, params, "GET", nil, download, true)
+func (e *CanvasError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+	if len(e.Messages) > 0 {
+		msg += ": " + strings.Join(e.Messages, "; ")
+	}
+	return msg
 }
 
-func mustPostObject(path string, params url.Values, upload interface{}, download interface{}) {
-	doRequest(path, params, "POST", upload, download, false)
+// isNotFound reports whether the error is Canvas saying the object doesn't exist.
+func isNotFound(err error) bool {
+	var canvasErr *CanvasError
+	return errors.As(err, &canvasErr) && canvasErr.StatusCode == http.StatusNotFound
 }
 
-func mustPutObject(path string, params url.Values, upload interface{}, download interface{}) {
-	doRequest(path, params, "PUT", upload, download, false)
+// newCanvasError builds the error for an unsuccessful response, picking out the
+// messages from its body. Canvas reports errors in a few different shapes, e.g.,
+// {"errors": [{"message": "..."}]} or {"errors": {"title": [{"message": "..."}]}},
+// so it collects every message it can find.
+func newCanvasError(method, path string, resp *http.Response, raw []byte) *CanvasError {
+	canvasErr := &CanvasError{
+		Method:     method,
+		Path:       path,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+	var body interface{}
+	if json.Unmarshal(raw, &body) == nil {
+		canvasErr.Messages = errorMessages(body, "")
+	}
+	return canvasErr
 }
 
-func prepareRequest(reqUrl string, params url.Values, method string, upload interface{}, download interface{}) (*http.Request, error) {
-	req, err := http.NewRequest(method, reqUrl, nil)
-	if err != nil {
-		return req, err
-	}
-
-	// add any parameters
-	if params != nil && len(params) > 0 {
-		req.URL.RawQuery = params.Encode()
-	}
-
-	if Config.apiReport {
-		log.Printf("%s %s", method, req.URL)
-	}
-
-	// set the headers
-	req.Header.Add("Authorization", "Bearer "+Config.Token)
-	if download != nil {
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Accept-Encoding", "gzip")
-	}
-
-	// upload the payload if any
-	if upload != nil && (method == "POST" || method == "PUT") {
-		req.Header.Add("Content-Type", "application/json")
-		payload := new(bytes.Buffer)
-		jw := json.NewEncoder(payload)
-		if err := jw.Encode(upload); err != nil {
-			log.Fatalf("doRequest: JSON error encoding object to upload: %v", err)
+func errorMessages(value interface{}, field string) []string {
+	messages := []string{}
+	switch v := value.(type) {
+	case string:
+		if field != "" {
+			v = field + ": " + v
 		}
-		req.Body = ioutil.NopCloser(payload)
-
-		if Config.apiDump {
-			log.Printf("Request data: %s", payload)
+		messages = append(messages, v)
+	case []interface{}:
+		for _, elt := range v {
+			messages = append(messages, errorMessages(elt, field)...)
 		}
-	}
-	return req, nil
-}
-
-func doRequest(path string, params url.Values, method string, upload interface{}, download interface{}, notfoundokay bool) bool {
-	if !strings.HasPrefix(path, "/") {
-		log.Panicf("doRequest path must start with /")
-	}
-	if method != "GET" && method != "POST" && method != "PUT" && method != "DELETE" {
-		log.Panicf("doRequest only recognizes GET, POST, PUT, and DELETE methods")
-	}
-
-	reqUrl := fmt.Sprintf("https://%s%s%s", Config.Host, urlPrefix, path)
-	req, err := prepareRequest(reqUrl, params, method, upload, download)
-	if err != nil {
-		log.Fatalf("error creating http request: %v\n", err)
-	}
-
-	paginated := false // assume not paginated
-	allResults := make([]map[string]interface{}, 0)
-	for {
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Fatalf("error connecting to %s: %v", Config.Host, err)
-		}
-		defer resp.Body.Close()
-		if notfoundokay && resp.StatusCode == http.StatusNotFound {
-			return false
-		}
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("unexpected status from %s: %s", reqUrl, resp.Status)
-			dumpBody(resp)
-			log.Fatalf("giving up")
-		}
-		gzipped := resp.Header.Get("Content-Encoding") == "gzip"
-
-		// grab next page url if paginated
-		links := lh.ParseHeader(resp.Header.Get("Link"))
-		next, ok := links["next"]["href"]
-		if !ok {
-			if !paginated {
-				// if non-paginated response, we're done
-				return parseResponse(resp.Body, gzipped, download)
-			} else {
-				// no more paginated results, grab last results and done
-				partResults := make([]map[string]interface{}, 0)
-				if parseResponse(resp.Body, gzipped, &partResults) {
-					allResults = append(allResults, partResults...)
-				}
-				break
+	case map[string]interface{}:
+		for _, key := range []string{"message", "errors", "error"} {
+			if inner, ok := v[key]; ok {
+				return errorMessages(inner, field)
 			}
 		}
-
-		// set up request for next page
-		paginated = true // at this point, we're paginated, set flag on the first time
-		// grab partial results
-		partResults := make([]map[string]interface{}, 0)
-		if parseResponse(resp.Body, gzipped, &partResults) {
-			allResults = append(allResults, partResults...)
+		// otherwise the errors are listed by the field they're about
+		fields := make([]string, 0, len(v))
+		for key := range v {
+			fields = append(fields, key)
 		}
-		// prepare for next request
-		req, err = prepareRequest(next, url.Values{}, method, upload, download)
-		if err != nil {
-			log.Fatalf("error creating http request: %v\n", err)
-		}
-	}
-
-	// re-encode all results
-	allJson, err := json.Marshal(allResults)
-	if err != nil {
-		return false
-	}
-	return json.Unmarshal(allJson, download) == nil
-}
-
-func parseResponse(body io.ReadCloser, gzipped bool, download interface{}) bool {
-	// parse the result if any
-	if download != nil {
-		if gzipped {
-			gz, err := gzip.NewReader(body)
-			if err != nil {
-				log.Fatalf("failed to decompress gzip result: %v", err)
-			}
-			body = gz
-			defer gz.Close()
-		}
-		decoder := json.NewDecoder(body)
-		if err := decoder.Decode(download); err != nil {
-			log.Fatalf("failed to parse result object from server: %v", err)
-		}
-
-		if Config.apiDump {
-			raw, err := json.MarshalIndent(download, "", "    ")
-			if err != nil {
-				log.Fatalf("doRequest: JSON error encoding downloaded object: %v", err)
-			}
-			log.Printf("Response data: %s", raw)
+		sort.Strings(fields)
+		for _, key := range fields {
+			messages = append(messages, errorMessages(v[key], key)...)
 		}
-
-		return true
 	}
-	return false
+	return messages
 }
 
 func courseDirectory(label string) string {
@@ -269,28 +292,38 @@ func courseDirectory(label string) string {
 	return label
 }
 
+// mustLoadConfig loads the profile to use from the user's config file into
+// Config. See activeProfile for how it's chosen.
 func mustLoadConfig() {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("unable to find home directory: %v", err)
+	rc := mustReadRc()
+	name, source := activeProfile(rc)
+	if name == "" {
+		log.Fatalf("Unable to load config file; try running '%s login'\n", os.Args[0])
 	}
-	if home == "" {
-		log.Fatalf("home directory is not setn")
+	profile, ok := rc.Profiles[name]
+	if !ok {
+		log.Fatalf("No profile named %s (from %s); try running '%s login --profile %s'", name, source, os.Args[0], name)
 	}
-	configFile := filepath.Join(home, perUserDotFile)
-
-	if raw, err := ioutil.ReadFile(configFile); err != nil {
-		log.Fatalf("Unable to load config file; try running '%s login'\n", os.Args[0])
-	} else if err := json.Unmarshal(raw, &Config); err != nil {
-		log.Printf("failed to parse %s: %v", configFile, err)
-		log.Fatalf("you may wish to try deleting the file and running '%s login' again\n", os.Args[0])
+	token, err := loadToken(name, profile)
+	if err != nil {
+		log.Fatalf("Failed to load token: %v", err)
+	}
+	Config.profileInUse = name
+	Config.Host = profile.Host
+	Config.Token = token
+	Config.oauth = nil
+	if profile.ClientId != "" && os.Getenv(tokenEnv) == "" {
+		if Config.oauth, err = newOAuthSource(name, profile, token); err != nil {
+			log.Fatal(err)
+		}
+		Config.Token = ""
 	}
 	if Config.apiDump {
 		Config.apiReport = true
 	}
 }
 
-func mustWriteConfig() {
+func rcPath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalf("unable to find home directory: %v", err)
@@ -298,34 +331,74 @@ func mustWriteConfig() {
 	if home == "" {
 		log.Fatalf("home directory is not set")
 	}
-	configFile := filepath.Join(home, perUserDotFile)
+	return filepath.Join(home, perUserDotFile)
+}
 
-	raw, err := json.MarshalIndent(&Config, "", "    ")
+// mustReadRc reads the user's config file. A missing file is the same as one
+// with no profiles.
+func mustReadRc() *rcFile {
+	configFile := rcPath()
+	rc := &rcFile{Profiles: make(map[string]*Profile)}
+	raw, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return rc
+	} else if err != nil {
+		log.Fatalf("error reading %s: %v", configFile, err)
+	}
+	if err := json.Unmarshal(raw, rc); err != nil {
+		log.Printf("failed to parse %s: %v", configFile, err)
+		log.Fatalf("you may wish to try deleting the file and running '%s login' again\n", os.Args[0])
+	}
+	if rc.Profiles == nil {
+		rc.Profiles = make(map[string]*Profile)
+	}
+
+	// config files from before profiles hold a single host and token
+	if rc.Host != "" {
+		if _, ok := rc.Profiles[defaultProfile]; !ok {
+			rc.Profiles[defaultProfile] = &Profile{Host: rc.Host, Token: rc.Token}
+		}
+		if rc.Default == "" {
+			rc.Default = defaultProfile
+		}
+		rc.Host, rc.Token = "", ""
+	}
+	return rc
+}
+
+func mustWriteRc(rc *rcFile) {
+	configFile := rcPath()
+
+	raw, err := json.MarshalIndent(rc, "", "    ")
 	if err != nil {
 		log.Fatalf("JSON error encoding cookie file: %v", err)
 	}
 	raw = append(raw, '\n')
 
-	if err = ioutil.WriteFile(configFile, raw, 0644); err != nil {
+	if err = ioutil.WriteFile(configFile, raw, 0600); err != nil {
+		log.Fatalf("error writing %s: %v", configFile, err)
+	}
+	// older versions wrote it readable by everyone
+	if err := os.Chmod(configFile, 0600); err != nil {
 		log.Fatalf("error writing %s: %v", configFile, err)
 	}
 }
 
-func dumpBody(resp *http.Response) {
+// readBody reads the whole response body, decompressing it if needed.
+func readBody(resp *http.Response) ([]byte, error) {
 	if resp.Body == nil {
-		return
+		return nil, nil
 	}
 
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		gz, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			log.Fatalf("failed to decompress gzip result: %v", err)
+			return nil, fmt.Errorf("failed to decompress gzip result: %v", err)
 		}
 		defer gz.Close()
-		io.Copy(os.Stderr, gz)
-	} else {
-		io.Copy(os.Stderr, resp.Body)
+		return ioutil.ReadAll(gz)
 	}
+	return ioutil.ReadAll(resp.Body)
 }
 
 // Reads the file's metadata into the given target struct and returns the
@@ -335,9 +408,9 @@ func readFile(filename string, target interface{}) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	fileParts := strings.Split(string(dat), "```")
-	err = yaml.Unmarshal([]byte(fileParts[1]), target)
-	return fileParts[2], err
+	metadata, body := splitFile(string(dat))
+	err = yaml.Unmarshal([]byte(metadata), target)
+	return body, err
 }
 
 func readYamlFile(filename string, target interface{}) error {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// runJobs runs count jobs on up to Config.jobs goroutines. Each job prints to
+// its own buffer, and once a job is done its output is printed and done is
+// called with its result, on the calling goroutine and in the order the jobs
+// were given. So the output reads the same as running them one at a time, and
+// done can prompt or touch shared state safely. If done returns an error, no
+// more jobs are started and runJobs returns that error once the running ones
+// finish.
+//
+// A dry run prints requests as they would be sent, which only makes sense one
+// at a time, so it always runs a single job at a time.
+func runJobs(count int, job func(i int, out io.Writer) error, done func(i int, err error) error) error {
+	workers := Config.jobs
+	if workers < 1 || Config.dryRun {
+		workers = 1
+	}
+	if workers == 1 {
+		for i := 0; i < count; i++ {
+			if err := done(i, job(i, os.Stdout)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type result struct {
+		out      bytes.Buffer
+		err      error
+		finished chan struct{}
+	}
+	results := make([]*result, count)
+	for i := range results {
+		results[i] = &result{finished: make(chan struct{})}
+	}
+
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i].err = job(i, &results[i].out)
+				close(results[i].finished)
+			}
+		}()
+	}
+	go func() {
+		defer close(indexes)
+		for i := 0; i < count; i++ {
+			select {
+			case indexes <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for i := 0; i < count && err == nil; i++ {
+		<-results[i].finished
+		os.Stdout.Write(results[i].out.Bytes())
+		err = done(i, results[i].err)
+	}
+	close(stop)
+	wg.Wait()
+	return err
+}
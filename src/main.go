@@ -1,10 +1,16 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/cobra"
@@ -21,21 +27,51 @@ const (
 	assignmentGroupPath  = assignmentGroupsPath + "/%d"
 	coursesPath          = "/courses"
 	coursePath           = coursesPath + "/%d"
+	discussionTopicsPath = coursePath + "/discussion_topics"
+	discussionTopicPath  = discussionTopicsPath + "/%d"
 	externalToolsPath    = coursePath + "/external_tools"
+	groupCategoriesPath  = coursePath + "/group_categories"
+	groupCategoryPath    = "/group_categories/%d"
 	modulesPath          = coursePath + "/modules"
 	modulePath           = modulesPath + "/%d"
+	moduleItemsPath      = modulePath + "/items"
+	moduleItemPath       = moduleItemsPath + "/%d"
 	pagesPath            = coursePath + "/pages"
 	pagePath             = pagesPath + "/%s"
 	quizzesPath          = coursePath + "/quizzes"
 	quizPath             = quizzesPath + "/%d"
 	quizQuestionsPath    = quizPath + "/questions"
+	quizQuestionPath     = quizQuestionsPath + "/%d"
+	quizReorderPath      = quizPath + "/reorder"
+	quizSubmissionsPath  = quizPath + "/submissions"
 )
 
 var Config struct {
-	Host      string `json:"host"`
-	Token     string `json:"token"`
-	apiReport bool
-	apiDump   bool
+	Host         string
+	Token        string
+	profile      string
+	profileInUse string // the profile chosen by mustLoadConfig
+	apiReport    bool
+	apiDump      bool
+	record       string
+	replay       string
+	courses      []string
+	strategy     string
+	dryRun       bool
+	applyWeights bool
+	prune        bool
+	yes          bool
+	force        bool
+	jobs         int
+	retries      int
+	maxBackoff   time.Duration
+	pin          bool
+	unpin        bool
+	oauth        *oauthSource // set by mustLoadConfig for profiles that logged in with OAuth
+	useOAuth     bool
+	clientId     string
+	clientSecret string
+	redirectPort int
 }
 
 func main() {
@@ -47,20 +83,76 @@ func main() {
 	}
 	cmd.PersistentFlags().BoolVarP(&Config.apiReport, "api", "", false, "report all API requests")
 	cmd.PersistentFlags().BoolVarP(&Config.apiDump, "api-dump", "", false, "dump API request and response data")
+	cmd.PersistentFlags().IntVarP(&Config.retries, "retries", "", defaultRetries,
+		"how many times to retry requests that fail because of throttling or a temporary error")
+	cmd.PersistentFlags().DurationVarP(&Config.maxBackoff, "max-backoff", "", defaultMaxBackoff,
+		"the longest to wait between retries, even if Canvas asks for longer")
+	cmd.PersistentFlags().StringVarP(&Config.record, "record", "", "",
+		"save every API request and response as fixture files in this directory")
+	cmd.PersistentFlags().StringVarP(&Config.replay, "replay", "", "",
+		"answer API requests from fixture files saved by --record instead of Canvas")
+
+	cmd.PersistentFlags().StringVarP(&Config.profile, "profile", "", "",
+		"the Canvas profile to use (default is $"+profileEnv+", then the one pinned to this directory, then the one chosen with 'profile use')")
 
 	// Login
 	cmdLogin := &cobra.Command{
-		Use:   "login <hostname> <token>",
+		Use:   "login [--profile <name>] <hostname> [<token>]",
 		Short: "login to Canvas",
 		Long: fmt.Sprintf("To log in, open Canvas and click on Account > " +
 			"Settings. Then under Approved Integrations click " +
 			"'+ New Access Token' and fill out the form as desired. " +
-			"Then click 'Generate Token'. Copy the token and paste here. " +
-			"You should only need to do this once per machine."),
+			"Then click 'Generate Token'. Copy the token and paste here, " +
+			"or leave it off to be asked for it. " +
+			"You should only need to do this once per machine. " +
+			"The token is kept in your keyring if you have one, or else in " +
+			"a file encrypted with a passphrase. " +
+			"Use --profile to log in to more than one Canvas instance."),
 		Run: CommandLogin,
 	}
+	cmdLogin.Flags().BoolVarP(&Config.useOAuth, "oauth", "", false,
+		"log in through Canvas in your browser using a developer key instead of pasting a token")
+	cmdLogin.Flags().StringVarP(&Config.clientId, "client-id", "", "",
+		"the developer key's client id, for --oauth")
+	cmdLogin.Flags().StringVarP(&Config.clientSecret, "client-secret", "", "",
+		"the developer key's client secret, for --oauth (asked for if not given)")
+	cmdLogin.Flags().IntVarP(&Config.redirectPort, "redirect-port", "", 0,
+		"the localhost port Canvas redirects back to, for --oauth (default is any free port)")
 	cmd.AddCommand(cmdLogin)
 
+	// Profile
+	cmdProfile := &cobra.Command{
+		Use:   "profile <command>",
+		Short: "Manage the Canvas instances you have logged in to",
+		Long:  "TODO instructions",
+	}
+	cmdProfileList := &cobra.Command{
+		Use:   "list",
+		Short: "List profiles, marking the one in use",
+		Long:  "TODO instructions",
+		Run:   CommandProfileList,
+	}
+	cmdProfile.AddCommand(cmdProfileList)
+	cmdProfileUse := &cobra.Command{
+		Use:   "use <name>",
+		Short: "Use the given profile by default, or with --pin, for the courses in this directory",
+		Long:  "TODO instructions",
+		Run:   CommandProfileUse,
+	}
+	cmdProfileUse.Flags().BoolVarP(&Config.pin, "pin", "", false,
+		"pin the profile to the courses in this directory instead of making it the default")
+	cmdProfileUse.Flags().BoolVarP(&Config.unpin, "unpin", "", false,
+		"stop pinning a profile to the courses in this directory")
+	cmdProfile.AddCommand(cmdProfileUse)
+	cmdProfileRemove := &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove profile",
+		Long:  "TODO instructions",
+		Run:   CommandProfileRemove,
+	}
+	cmdProfile.AddCommand(cmdProfileRemove)
+	cmd.AddCommand(cmdProfile)
+
 	// Init
 	cmdInit := &cobra.Command{
 		Use:   "init",
@@ -106,6 +198,12 @@ func main() {
 		Long:  "TODO instructions",
 		Run:   CommandPull,
 	}
+	cmdPull.PersistentFlags().StringSliceVarP(&Config.courses, "course", "c", nil,
+		"only pull from these courses (canvas id, section number, or part of the name)")
+	cmdPull.PersistentFlags().StringVarP(&Config.strategy, "strategy", "s", strategyPrompt,
+		"how to resolve files changed both locally and in Canvas: "+strings.Join(strategies, ", "))
+	cmdPull.PersistentFlags().IntVarP(&Config.jobs, "jobs", "j", 1,
+		"how many components to pull from Canvas at the same time")
 	cmd.AddCommand(cmdPull)
 
 	// Push
@@ -115,8 +213,44 @@ func main() {
 		Long:  "TODO instructions",
 		Run:   CommandPush,
 	}
+	cmdPush.PersistentFlags().StringSliceVarP(&Config.courses, "course", "c", nil,
+		"only push to these courses (canvas id, section number, or part of the name)")
+	cmdPush.PersistentFlags().BoolVarP(&Config.dryRun, "dry-run", "n", false,
+		"show the requests a push would make without changing anything in Canvas")
+	cmdPush.PersistentFlags().IntVarP(&Config.jobs, "jobs", "j", 1,
+		"how many components to push to Canvas at the same time")
+	cmdPush.PersistentFlags().BoolVarP(&Config.applyWeights, "apply-weights", "", false,
+		"when pushing assignment groups, also weight final grades by assignment group")
+	cmdPush.PersistentFlags().BoolVarP(&Config.prune, "prune", "", false,
+		"delete components from Canvas whose local files were deleted")
+	cmdPush.PersistentFlags().BoolVarP(&Config.yes, "yes", "y", false,
+		"don't ask before deleting anything with --prune")
+	cmdPush.PersistentFlags().BoolVarP(&Config.force, "force", "", false,
+		"with --prune, also delete assignments and quizzes that students have submitted to")
 	cmd.AddCommand(cmdPush)
 
+	// Status
+	cmdStatus := &cobra.Command{
+		Use:   "status",
+		Short: "show what has changed locally and in Canvas since the last sync",
+		Long:  "TODO instructions",
+		Run:   CommandStatus,
+	}
+	cmdStatus.PersistentFlags().StringSliceVarP(&Config.courses, "course", "c", nil,
+		"only show these courses (canvas id, section number, or part of the name)")
+	cmd.AddCommand(cmdStatus)
+
+	// Diff
+	cmdDiff := &cobra.Command{
+		Use:   "diff [component_type] [component_id]",
+		Short: "show what pushing a single component, or all of that type if blank, would change",
+		Long:  "TODO instructions",
+		Run:   CommandDiff,
+	}
+	cmdDiff.PersistentFlags().StringSliceVarP(&Config.courses, "course", "c", nil,
+		"only diff against these courses (canvas id, section number, or part of the name)")
+	cmd.AddCommand(cmdDiff)
+
 	cmd.Execute()
 }
 
@@ -125,11 +259,13 @@ type LoginSession struct {
 }
 
 func CommandLogin(cmd *cobra.Command, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: %s login <hostname> <token>", os.Args[0])
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatalf("Usage: %s login [--profile <name>] <hostname> [<token>]", os.Args[0])
 	}
-	hostname, token := args[0], args[1]
+	hostname := args[0]
 
+	// https is the default, but an http:// host is kept as is, e.g., for a
+	// local server standing in for Canvas
 	protocol := "https://"
 	if strings.HasPrefix(hostname, protocol) {
 		hostname = hostname[len(protocol):]
@@ -138,14 +274,92 @@ func CommandLogin(cmd *cobra.Command, args []string) {
 		hostname = hostname[:len(hostname)-1]
 	}
 
-	// set up config
+	// the token can be left off to keep it out of the shell history
+	var token string
+	var oauth *oauthToken
+	fromEnv := false
+	switch {
+	case Config.useOAuth:
+		if len(args) != 1 || Config.clientId == "" {
+			log.Fatalf("Usage: %s login --oauth --client-id <id> [--client-secret <secret>] <hostname>", os.Args[0])
+		}
+		secret := Config.clientSecret
+		if secret == "" {
+			var err error
+			if secret, err = readSecret("Client secret: "); err != nil {
+				log.Fatalf("No client secret given: %v", err)
+			}
+		}
+		var err error
+		if oauth, err = oauthLogin(hostname, Config.clientId, secret, Config.redirectPort); err != nil {
+			log.Fatalf("OAuth login failed: %v", err)
+		}
+		token = oauth.AccessToken
+	case len(args) == 2:
+		token = args[1]
+	case os.Getenv(tokenEnv) != "":
+		token = os.Getenv(tokenEnv)
+		fromEnv = true
+	default:
+		var err error
+		if token, err = readSecret("Token: "); err != nil {
+			log.Fatalf("No token given: %v", err)
+		}
+	}
+
+	// make sure the token works before keeping it
 	Config.Host = hostname
 	Config.Token = token
+	Config.oauth = nil
+	user, err := getSelf(newClient())
+	if err != nil {
+		var canvasErr *CanvasError
+		if errors.As(err, &canvasErr) && canvasErr.StatusCode == http.StatusUnauthorized {
+			log.Fatalf("Canvas at %s did not accept the token", hostname)
+		}
+		log.Fatalf("Failed to check the token: %v", err)
+	}
+
+	// log in to the profile that would be used anyway unless one is named
+	rc := mustReadRc()
+	name, _ := activeProfile(rc)
+	if name == "" {
+		name = defaultProfile
+	}
+	profile, ok := rc.Profiles[name]
+	if !ok {
+		profile = new(Profile)
+		rc.Profiles[name] = profile
+	}
+	profile.Host = hostname
+	profile.ClientId = ""
+	switch {
+	case fromEnv:
+		// nothing to store; it will come from the environment every time
+		removeToken(name, profile)
+		profile.TokenStore, profile.Token = tokenStoreEnv, ""
+	case oauth != nil:
+		raw, err := json.Marshal(oauth)
+		if err != nil {
+			log.Fatalf("JSON error encoding token: %v", err)
+		}
+		if err := storeToken(name, profile, string(raw)); err != nil {
+			log.Fatalf("Failed to store token: %v", err)
+		}
+		profile.ClientId = Config.clientId
+	default:
+		if err := storeToken(name, profile, token); err != nil {
+			log.Fatalf("Failed to store token: %v", err)
+		}
+	}
+	if rc.Default == "" {
+		rc.Default = name
+	}
 
 	// save config for later use
-	mustWriteConfig()
+	mustWriteRc(rc)
 
-	log.Println("login successful")
+	log.Printf("Logged in to %s as %s (profile %s)", hostname, user, name)
 }
 
 func CommandInit(cmd *cobra.Command, args []string) {
@@ -156,6 +370,7 @@ func CommandInit(cmd *cobra.Command, args []string) {
 
 func CommandCourseAdd(cmd *cobra.Command, args []string) {
 	mustLoadConfig()
+	client := newClient()
 	db := findDb()
 	defer db.Close()
 
@@ -168,12 +383,25 @@ func CommandCourseAdd(cmd *cobra.Command, args []string) {
 		log.Fatalf("Course exists")
 	}
 
-	course, err := pullCourse(db, courseId)
+	course, err := pullCourse(client, db, courseId)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	course.Save(db)
+	if err := course.recordSyllabusSync(db, course.Syllabus); err != nil {
+		log.Fatalf("Failed to record the syllabus: %v", err)
+	}
+
+	// courses in a directory come from one Canvas instance, so later commands
+	// here keep using this profile whatever the default becomes
+	if pinned, err := getSetting(db, profileSetting); err != nil {
+		log.Fatalf("Failed to read pinned profile: %v", err)
+	} else if pinned == "" {
+		if err := setSetting(db, profileSetting, Config.profileInUse); err != nil {
+			log.Fatalf("Failed to pin profile: %v", err)
+		}
+	}
 }
 
 func CommandCourseList(cmd *cobra.Command, args []string) {
@@ -216,142 +444,392 @@ func CommandCourseRemove(cmd *cobra.Command, args []string) {
 	fmt.Println("Removed course", courses[0].Name)
 }
 
+func CommandProfileList(cmd *cobra.Command, args []string) {
+	rc := mustReadRc()
+	if len(rc.Profiles) == 0 {
+		log.Fatalf("No profiles found; try running '%s login'", os.Args[0])
+	}
+	active, source := activeProfile(rc)
+
+	names := make([]string, 0, len(rc.Profiles))
+	for name := range rc.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mark := " "
+		if name == active {
+			mark = "*"
+		}
+		fmt.Printf("%s %s\t%s\n", mark, name, rc.Profiles[name].Host)
+	}
+	if _, ok := rc.Profiles[active]; active != "" && !ok {
+		log.Printf("%s names profile %s, which does not exist", source, active)
+	} else if source != perUserDotFile {
+		fmt.Printf("(%s chosen by %s)\n", active, source)
+	}
+}
+
+func CommandProfileUse(cmd *cobra.Command, args []string) {
+	if Config.unpin {
+		if len(args) != 0 {
+			log.Fatalf("Usage: %s profile use --unpin", os.Args[0])
+		}
+		db := findDb()
+		defer db.Close()
+		if err := deleteSetting(db, profileSetting); err != nil {
+			log.Fatalf("Failed to unpin profile: %v", err)
+		}
+		fmt.Println("No profile is pinned to the courses in this directory")
+		return
+	}
+	if len(args) != 1 {
+		log.Fatalf("Usage: %s profile use [--pin] <name>", os.Args[0])
+	}
+	name := args[0]
+
+	rc := mustReadRc()
+	if _, ok := rc.Profiles[name]; !ok {
+		log.Fatal(profileUsage(name))
+	}
+	if Config.pin {
+		db := findDb()
+		defer db.Close()
+		if err := setSetting(db, profileSetting, name); err != nil {
+			log.Fatalf("Failed to pin profile: %v", err)
+		}
+		fmt.Printf("Pinned profile %s to the courses in this directory\n", name)
+		return
+	}
+	rc.Default = name
+	mustWriteRc(rc)
+	fmt.Printf("Using profile %s by default\n", name)
+}
+
+func CommandProfileRemove(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: %s profile remove <name>", os.Args[0])
+	}
+	name := args[0]
+
+	rc := mustReadRc()
+	if _, ok := rc.Profiles[name]; !ok {
+		log.Fatal(profileUsage(name))
+	}
+	if err := removeToken(name, rc.Profiles[name]); err != nil {
+		log.Printf("Failed to remove the token for %s: %v", name, err)
+	}
+	delete(rc.Profiles, name)
+	if rc.Default == name {
+		rc.Default = ""
+		// with only one left there's no question which to use
+		if len(rc.Profiles) == 1 {
+			for other := range rc.Profiles {
+				rc.Default = other
+			}
+		}
+	}
+	mustWriteRc(rc)
+	fmt.Println("Removed profile", name)
+	if rc.Default == "" && len(rc.Profiles) > 0 {
+		fmt.Printf("There is no default profile now; choose one with '%s profile use'\n", os.Args[0])
+	}
+	if pinnedProfile() == name {
+		log.Printf("The courses in this directory are pinned to %s; log in to it again or run '%s profile use --pin' with another profile", name, os.Args[0])
+	}
+}
+
+func mustSelectCourses(db *sql.DB) []*Course {
+	courses, err := selectCourses(db, Config.courses)
+	if err != nil {
+		log.Fatalf("Failed to select courses: %v", err)
+	}
+	if len(courses) == 0 {
+		log.Fatalf("No courses found; try running '%s course add'", os.Args[0])
+	}
+	return courses
+}
+
 func CommandPull(cmd *cobra.Command, args []string) {
+	validStrategy := false
+	for _, strategy := range strategies {
+		validStrategy = validStrategy || Config.strategy == strategy
+	}
+	if !validStrategy {
+		log.Fatalf("Invalid strategy %s, expected one of %s", Config.strategy, strings.Join(strategies, ", "))
+	}
+
 	mustLoadConfig()
+	client := newClient()
 	db := findDb()
 	defer db.Close()
+	courses := mustSelectCourses(db)
 
 	switch len(args) {
 	case 0:
 		// TODO: pull all components of all types
-		pullCourses(db)
+		if _, err := pullCourses(client, db, courses); err != nil {
+			recordFailure("pull courses", err)
+		}
 	case 1:
 		// pull all components of single type
 		componentType := args[0]
+		var err error
 		switch componentType {
-		case "assignments", "a":
-			pullAssignments(db)
-		case "assignment_groups", "ag":
-			pullAssignmentGroups(db)
-		case "courses", "c":
-			pullCourses(db)
-		case "modules", "m":
-			pullModules(db)
-		case "pages", "p":
-			pullPages(db)
-		case "quizzes", "q":
-			pullQuizzes(db)
+		case "courses", "course", "c":
+			_, err = pullCourses(client, db, courses)
 		default:
-			log.Fatalf("Invalid component type: %s", componentType)
+			kind, ok := findComponentKind(componentType)
+			if !ok {
+				log.Fatalf("Invalid component type: %s", componentType)
+			}
+			err = pullComponents(client, db, courses, kind.list, kind.path)
+		}
+		if err != nil {
+			recordFailure("pull "+componentType, err)
 		}
 	case 2:
 		// pull single item of single type
 		componentType := args[0]
 		componentFilepath := args[1]
+		var err error
 		switch componentType {
 		case "assignments", "assignment", "a":
 			assignment := new(Assignment)
-			_, err := readFile(componentFilepath, assignment)
+			_, err = readFile(componentFilepath, assignment)
 			if err != nil {
 				log.Fatalf("Failed to load assignment from file %s\n", componentFilepath)
 			}
-			assignment.Pull(db)
+			err = assignment.Pull(client, db, courses)
 		case "assignment_groups", "assignment_group", "ag":
 			ag := new(AssignmentGroup)
-			err := readYamlFile(componentFilepath, ag)
+			err = readYamlFile(componentFilepath, ag)
 			if err != nil {
 				log.Fatalf("Failed to load module from file %s\n", componentFilepath)
 			}
-			ag.Pull(db)
+			err = ag.Pull(client, db, courses)
 		case "courses", "course", "c":
-			courses, err := matchCourse(db, componentFilepath)
-			if err != nil || len(courses) != 1 {
+			var matches []*Course
+			matches, err = matchCourse(db, componentFilepath)
+			if err != nil || len(matches) != 1 {
 				log.Fatalf("Failed to find a single course for %s. %v\n", componentFilepath, err)
 			}
-			pullCourse(db, courses[0].CanvasId)
+			_, err = pullCourses(client, db, matches)
+		case "discussions", "discussion", "d":
+			topic := new(DiscussionTopic)
+			_, err = readFile(componentFilepath, topic)
+			if err != nil {
+				log.Fatalf("Failed to load discussion from file %s\n", componentFilepath)
+			}
+			err = topic.Pull(client, db, courses)
 		case "modules", "module", "m":
 			module := new(Module)
-			err := readYamlFile(componentFilepath, module)
+			err = readYamlFile(componentFilepath, module)
 			if err != nil {
 				log.Fatalf("Failed to load module from file %s\n", componentFilepath)
 			}
-			module.Pull(db)
+			err = module.Pull(client, db, courses)
 		case "pages", "page", "p":
 			page := new(Page)
 			page.Url = getPageUrlFromFilepath(componentFilepath)
-			page.Pull(db)
+			err = page.Pull(client, db, courses)
 		case "quizzes", "quiz", "q":
 			quiz := new(Quiz)
-			_, err := readFile(componentFilepath, quiz)
+			_, err = readFile(componentFilepath, quiz)
 			if err != nil {
 				log.Fatalf("Failed to load quiz from file %s\n", componentFilepath)
 			}
-			quiz.Pull(db)
+			err = quiz.Pull(client, db, courses)
 		default:
 			log.Fatalf("Invalid component type: %s", componentType)
 		}
+		if err != nil {
+			recordFailure("pull "+componentFilepath, err)
+		}
 	default:
 		log.Fatal("Too many arguments")
 	}
+	reportFailures()
 }
 
 func CommandPush(cmd *cobra.Command, args []string) {
 	mustLoadConfig()
+	client := newClient()
 	db := findDb()
 	defer db.Close()
+	courses := mustSelectCourses(db)
+	if Config.applyWeights {
+		if len(args) == 0 || args[0] != "assignment_groups" && args[0] != "assignment_group" && args[0] != "ag" {
+			log.Fatal("--apply-weights only goes with pushing assignment groups")
+		}
+	}
+	pruneKinds := componentKinds
+	if Config.prune && len(args) > 0 {
+		kind, ok := findComponentKind(args[0])
+		if !ok || len(args) > 1 {
+			log.Fatal("--prune goes with pushing everything, or everything of one of these types: " + strings.Join(pruneOrder, ", "))
+		}
+		pruneKinds = []componentKind{kind}
+	}
 
 	switch len(args) {
 	case 0:
 		// push all components of all types
-		pushCourses(db)
-		pushPages(db)
+		pushCourses(client, db, courses)
+		pages, _ := findComponentKind("pages")
+		if err := pushKind(client, db, courses, pages); err != nil {
+			recordFailure("push pages", err)
+		}
 	case 1:
 		// push all components of single type
 		componentType := args[0]
+		var err error
 		switch componentType {
-		case "assignments", "a":
-			pushAssignments(db)
-		case "courses", "c":
-			pushCourses(db)
-		case "external_tools", "et":
-			pushExternalTools(db)
-		case "pages", "p":
-			pushPages(db)
+		case "courses", "course", "c":
+			pushCourses(client, db, courses)
+		case "external_tools", "external_tool", "et":
+			err = pushExternalTools(client, db, courses)
 		default:
-			log.Fatalf("Invalid component type: %s", componentType)
+			kind, ok := findComponentKind(componentType)
+			if !ok {
+				log.Fatalf("Invalid component type: %s", componentType)
+			}
+			err = pushKind(client, db, courses, kind)
+		}
+		if err != nil {
+			recordFailure("push "+componentType, err)
 		}
 	case 2:
 		// push single item of single type
 		componentType := args[0]
 		componentFilepath := args[1]
+		var err error
 		switch componentType {
 		case "assignments", "assignment", "a":
-			err := pushAssignment(db, componentFilepath)
-			if err != nil {
-				log.Fatalf("Failed to push assignment %s: %v\n", componentFilepath, err)
-			}
+			err = pushAssignment(client, db, courses, componentFilepath, os.Stdout)
+		case "assignment_groups", "assignment_group", "ag":
+			err = pushAssignmentGroup(client, db, courses, componentFilepath, os.Stdout)
 		case "courses", "course", "c":
-			courses, err := matchCourse(db, componentFilepath)
+			var matches []*Course
+			matches, err = matchCourse(db, componentFilepath)
 			if err != nil {
 				log.Fatalf("Error finding course %s\n", componentFilepath)
 			}
-			if len(courses) != 1 {
-				for _, c := range courses {
+			if len(matches) != 1 {
+				for _, c := range matches {
 					fmt.Println(c)
 				}
-				log.Fatalf("Failed to find a single match for %s. Narrow search query or select course id from list.")
+				log.Fatalf("Failed to find a single match for %s. Narrow search query or select course id from list.", componentFilepath)
 			}
-			courses[0].Push()
+			err = matches[0].Push(client, db, os.Stdout)
+		case "discussions", "discussion", "d":
+			err = pushDiscussionTopic(client, db, courses, componentFilepath, os.Stdout)
 		case "external_tools", "external_tool", "et":
-			pushExternalTool(db, componentFilepath)
+			err = pushExternalTool(client, db, courses, componentFilepath, os.Stdout)
+		case "modules", "module", "m":
+			err = pushModule(client, db, courses, componentFilepath, os.Stdout)
 		case "pages", "page", "p":
 			pageUrl := getPageUrlFromFilepath(componentFilepath)
 			// TODO: flag for notifying participants of update? set field notify_of_update
-			pushPage(db, pageUrl)
+			err = pushPage(client, db, courses, pageUrl, os.Stdout)
+		case "quizzes", "quiz", "q":
+			err = pushQuiz(client, db, courses, componentFilepath, os.Stdout)
 		default:
 			log.Fatalf("Invalid component type: %s", componentType)
 		}
+		if err != nil {
+			recordFailure("push "+componentFilepath, err)
+		}
 	default:
 		log.Fatal("Too many arguments")
 	}
+	if Config.prune {
+		if err := pruneComponents(client, db, courses, pruneKinds); err != nil {
+			recordFailure("prune", err)
+		}
+	}
+	if Config.applyWeights {
+		applyGroupWeights(client, courses)
+	}
+	reportFailures()
+}
+
+func CommandStatus(cmd *cobra.Command, args []string) {
+	mustLoadConfig()
+	client := newClient()
+	db := findDb()
+	defer db.Close()
+	courses := mustSelectCourses(db)
+
+	for i, course := range courses {
+		statuses, err := courseStatus(client, db, course)
+		if err != nil {
+			recordFailure("get status of "+course.Name, err)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(course.Name)
+		for _, status := range statuses {
+			fmt.Printf("  %s\n", status)
+		}
+	}
+	reportFailures()
+}
+
+func CommandDiff(cmd *cobra.Command, args []string) {
+	mustLoadConfig()
+	client := newClient()
+	db := findDb()
+	defer db.Close()
+	courses := mustSelectCourses(db)
+
+	if len(args) > 2 {
+		log.Fatal("Too many arguments")
+	}
+
+	// the syllabus isn't stored like the other components
+	if len(args) == 0 || args[0] == "courses" || args[0] == "course" || args[0] == "c" {
+		for _, course := range courses {
+			diff, err := diffSyllabus(client, course)
+			if err != nil {
+				recordFailure("diff syllabus in "+course.Name, err)
+				continue
+			}
+			fmt.Print(diff)
+		}
+		if len(args) > 0 {
+			reportFailures()
+			return
+		}
+	}
+
+	kinds := componentKinds
+	if len(args) > 0 {
+		kind, ok := findComponentKind(args[0])
+		if !ok {
+			log.Fatalf("Invalid component type: %s", args[0])
+		}
+		kinds = []componentKind{kind}
+	}
+
+	for _, kind := range kinds {
+		var components []Component
+		if len(args) == 2 {
+			component, err := kind.load(args[1])
+			if err != nil {
+				log.Fatalf("Failed to load %s from file %s: %v", kind.name, args[1], err)
+			}
+			components = []Component{component}
+		} else {
+			var err error
+			components, err = kind.loadComponents()
+			if err != nil {
+				log.Fatalf("Failed to load %s: %v", kind.name, err)
+			}
+		}
+		diffComponents(client, db, courses, kind, components)
+	}
+	reportFailures()
 }
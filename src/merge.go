@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/russross/meddler"
+)
+
+const (
+	fileBasesTable = "file_bases"
+
+	// ways to resolve a file that changed both locally and in Canvas
+	strategyPrompt    = "prompt"
+	strategyOverwrite = "overwrite"
+	strategyKeep      = "keep"
+	strategyMarkers   = "markers"
+	strategyAbort     = "abort"
+)
+
+var strategies = []string{strategyPrompt, strategyOverwrite, strategyKeep, strategyMarkers, strategyAbort}
+
+var errPullAborted = errors.New("pull aborted")
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// FileBase is the contents of a local file as of the last time it was synced
+// with Canvas. It's the common ancestor when merging local and Canvas changes.
+type FileBase struct {
+	Id      int    `meddler:"id,pk"`
+	Path    string `meddler:"path"`
+	Content string `meddler:"content"`
+}
+
+func findFileBase(db *sql.DB, path string) (*FileBase, error) {
+	base := new(FileBase)
+	err := meddler.QueryRow(db, base, "SELECT * FROM "+fileBasesTable+" WHERE path = ?", path)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return base, err
+}
+
+func saveFileBase(db *sql.DB, path, content string) error {
+	base, err := findFileBase(db, path)
+	if err != nil {
+		return err
+	}
+	if base == nil {
+		base = &FileBase{Path: path}
+	}
+	base.Content = content
+	return meddler.Save(db, fileBasesTable, base)
+}
+
+// saveFileBases records the current contents of local files as their synced
+// versions, e.g., right after they were pushed.
+func saveFileBases(db *sql.DB, paths ...string) error {
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := saveFileBase(db, path, string(contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFileBases hashes the synced versions of the given files the same way
+// hashFiles hashes their current contents, so the two can be compared. Files
+// without a synced version are hashed as they are now.
+func hashFileBases(db *sql.DB, paths ...string) (string, error) {
+	var text strings.Builder
+	for _, path := range paths {
+		base, err := findFileBase(db, path)
+		if err != nil {
+			return "", err
+		}
+		if base != nil {
+			text.WriteString(base.Content)
+			continue
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		text.Write(contents)
+	}
+	return hashString(text.String()), nil
+}
+
+// syncFile writes what was pulled from Canvas to a local file without losing
+// local changes. The version from the last sync is the common ancestor: if only
+// one side changed since then, that side wins. If both did, the changes are
+// merged, and anything that can't be merged is resolved with Config.strategy.
+func syncFile(db *sql.DB, path, remote string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	localExists := err == nil
+	local := string(contents)
+
+	base, err := findFileBase(db, path)
+	if err != nil {
+		return err
+	}
+
+	text := remote
+	switch {
+	case !localExists, local == remote:
+	case base != nil && local == base.Content:
+		// only changed in Canvas
+	case base != nil && remote == base.Content:
+		// only changed locally
+		fmt.Printf("  keeping local changes to %s\n", path)
+		text = local
+	default:
+		baseContent := ""
+		if base != nil {
+			baseContent = base.Content
+		}
+		merged, conflicts := merge3(baseContent, local, remote)
+		text = merged
+		if conflicts == 0 {
+			fmt.Printf("  merged local and Canvas changes to %s\n", path)
+		} else {
+			text, err = resolveConflict(path, local, remote, merged, conflicts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !localExists || text != local {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+	// whatever we kept, Canvas's version is now the last one we've seen
+	return saveFileBase(db, path, remote)
+}
+
+// resolveConflict decides what to write to a file whose local and Canvas
+// changes overlap, prompting the user if no strategy was given.
+func resolveConflict(path, local, remote, merged string, conflicts int) (string, error) {
+	strategy := Config.strategy
+	for strategy == strategyPrompt {
+		fmt.Printf("%s changed both locally and in Canvas (%d conflicting change(s))\n", path, conflicts)
+		fmt.Print("  [o]verwrite with Canvas, [k]eep local, write conflict [m]arkers, show [d]iff, or [a]bort? ")
+		answer, err := stdin.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("no answer for %s; use --strategy when not running interactively", path)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "o", "overwrite":
+			strategy = strategyOverwrite
+		case "k", "keep":
+			strategy = strategyKeep
+		case "m", "markers":
+			strategy = strategyMarkers
+		case "d", "diff":
+			fmt.Print(unifiedDiff(path, path+" (Canvas)", local, remote))
+		case "a", "abort":
+			strategy = strategyAbort
+		}
+	}
+
+	switch strategy {
+	case strategyOverwrite:
+		return remote, nil
+	case strategyKeep:
+		fmt.Printf("  keeping local version of %s\n", path)
+		return local, nil
+	case strategyMarkers:
+		fmt.Printf("  wrote conflict markers to %s\n", path)
+		return merged, nil
+	case strategyAbort:
+		return "", errPullAborted
+	}
+	return "", fmt.Errorf("unknown strategy %q, expected one of %s", strategy, strings.Join(strategies, ", "))
+}
+
+// matchLines maps each line of base to the line it matches in other, or -1 if
+// the line was changed or removed.
+func matchLines(base, other []string) []int {
+	matches := make([]int, len(base))
+	i, j := 0, 0
+	for _, line := range diffLines(base, other) {
+		switch line.op {
+		case ' ':
+			matches[i] = j
+			i++
+			j++
+		case '-':
+			matches[i] = -1
+			i++
+		case '+':
+			j++
+		}
+	}
+	return matches
+}
+
+// merge3 merges the changes made to base in local and remote, line by line. The
+// stretches between lines that are unchanged on both sides are taken from
+// whichever side changed them; if both sides changed the same stretch
+// differently, it's written between conflict markers. Returns the merged text
+// and the number of conflicts.
+func merge3(base, local, remote string) (string, int) {
+	baseLines, localLines, remoteLines := splitLines(base), splitLines(local), splitLines(remote)
+	inLocal := matchLines(baseLines, localLines)
+	inRemote := matchLines(baseLines, remoteLines)
+
+	merged := make([]string, 0, len(localLines))
+	conflicts := 0
+	i, a, b := 0, 0, 0
+	for {
+		// find the next line that's unchanged on both sides
+		k := i
+		for k < len(baseLines) && (inLocal[k] < 0 || inRemote[k] < 0) {
+			k++
+		}
+		ka, kb := len(localLines), len(remoteLines)
+		if k < len(baseLines) {
+			ka, kb = inLocal[k], inRemote[k]
+		}
+
+		if k == i && ka == a && kb == b && k < len(baseLines) {
+			merged = append(merged, baseLines[k])
+			i, a, b = i+1, a+1, b+1
+			continue
+		}
+
+		// resolve the stretch up to it
+		baseChunk, localChunk, remoteChunk := baseLines[i:k], localLines[a:ka], remoteLines[b:kb]
+		switch {
+		case equalLines(localChunk, baseChunk):
+			merged = append(merged, remoteChunk...)
+		case equalLines(remoteChunk, baseChunk), equalLines(localChunk, remoteChunk):
+			merged = append(merged, localChunk...)
+		default:
+			conflicts++
+			merged = append(merged, "<<<<<<< local")
+			merged = append(merged, localChunk...)
+			merged = append(merged, "=======")
+			merged = append(merged, remoteChunk...)
+			merged = append(merged, ">>>>>>> canvas")
+		}
+
+		if k == len(baseLines) {
+			break
+		}
+		i, a, b = k, ka, kb
+	}
+
+	if len(merged) == 0 {
+		return "", conflicts
+	}
+	return strings.Join(merged, "\n") + "\n", conflicts
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
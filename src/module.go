@@ -3,7 +3,9 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
 
 	"github.com/russross/meddler"
 	"gopkg.in/yaml.v2"
@@ -27,14 +29,17 @@ type Module struct {
 	RequireSequentialProgress bool `json:"require_sequential_progress" yaml:"require_sequential_progress" meddler:"require_sequential_progress"`
 	// IDs of Modules that must be completed before this one is unlocked
 	PrerequisiteModuleIds []int `json:"prerequisite_module_ids" yaml:"prerequisite_module_ids" meddler:"prerequisite_module_ids"`
+	// The local names of the modules that must be completed before this one is
+	// unlocked. These are what get pushed, since the ids differ in every course.
+	Prerequisites []string `json:"-" yaml:"prerequisites,omitempty" meddler:"-"`
 	// The number of items in the module TODO: view only?
 	ItemsCount int `json:"items_count" yaml:"items_count" meddler:"items_count"`
 	// The API URL to retrive this module's items TODO: view only?
 	ItemsUrl string `json:"items_url" yaml:"items_url" meddler:"items_url"`
-	// The contents of this module, as an array of Module Items. (Present only if
-	// requested via include[]=items AND the module is not deemed too large by
-	// Canvas.)
-	Items []ModuleItem `json:"items" yaml:"items" meddler:"items"`
+	// The contents of this module, as an array of Module Items. These are
+	// pulled from the module's items endpoint, like quiz questions. If a local
+	// module has no items at all, pushing it leaves its items alone.
+	Items []ModuleItem `json:"-" yaml:"items" meddler:"items"`
 	// (Optional) Whether this module is published. This field is present only if
 	// the caller has permission to view unpublished modules.
 	Published bool `json:"published" yaml:"published" meddler:"published"`
@@ -69,6 +74,13 @@ type ModuleItem struct {
 	ExternalUrl string `json:"external_url" yaml:"external_url" meddler:"external_url"`
 	// (only for 'ExternalTool' type) whether the external tool opens in a new tab
 	NewTab bool `json:"new_tab" yaml:"new_tab" meddler:"new_tab"`
+	// the local component this item links to, if it's a page, assignment,
+	// quiz, or discussion. These are what get pushed, since content_id differs
+	// in every course.
+	Page       string `json:"-" yaml:"page,omitempty" meddler:"-"`
+	Assignment string `json:"-" yaml:"assignment,omitempty" meddler:"-"`
+	Quiz       string `json:"-" yaml:"quiz,omitempty" meddler:"-"`
+	Discussion string `json:"-" yaml:"discussion,omitempty" meddler:"-"`
 	// Completion requirement for this module item
 	CompletionRequirement CompletionRequirement `json:"completion_requirement" yaml:"completion_requirement" meddler:"completion_requirement"`
 	// (Optional) Whether this module item is published. This field is present only
@@ -82,42 +94,434 @@ type CompletionRequirement struct {
 	Completed bool   `json:"completed" yaml:"completed" meddler:"completed"`
 }
 
-func getModules(db *sql.DB) []*Module {
+func getModules(client *CanvasClient, course *Course) ([]*Module, error) {
 	modules := make([]*Module, 0)
-	courses, _ := findCourses(db)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	reqUrl := fmt.Sprintf(modulesPath, courseId)
-	mustGetObject(reqUrl, values, &modules)
-	return modules
+	reqUrl := fmt.Sprintf(modulesPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &modules)
+	return modules, err
 }
 
-func pullModules(db *sql.DB) {
-	modules := getModules(db)
+func getModuleItems(client *CanvasClient, courseId, moduleId int) ([]ModuleItem, error) {
+	items := make([]ModuleItem, 0)
+	values := url.Values{}
+	values.Add("per_page", "100")
+	reqUrl := fmt.Sprintf(moduleItemsPath, courseId, moduleId)
+	err := client.getList(reqUrl, values, &items)
+	return items, err
+}
+
+func readModuleFile(filepath string) (Component, error) {
+	module := new(Module)
+	err := readYamlFile(filepath, module)
+	return module, err
+}
+
+func listModules(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	modules, err := getModules(client, course)
 	for _, module := range modules {
-		module.Pull(db)
+		components = append(components, module)
+	}
+	return components, err
+}
+
+func pullModules(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listModules, modulePath)
+}
+
+func pushModule(client *CanvasClient, db *sql.DB, courses []*Course, filepath string, out io.Writer) error {
+	module, err := readModuleFile(filepath)
+	if err != nil {
+		return err
 	}
+	return module.(*Module).Push(client, db, courses, out)
+}
+
+// modulesByPosition is the order modules are pushed in, so a module always
+// exists in Canvas before the modules that require it are pushed.
+func modulesByPosition(a, b Component) bool {
+	return a.(*Module).Position < b.(*Module).Position
 }
 
 func (module *Module) Slug() string {
 	return slug(module.Name)
 }
 
-func (module *Module) Dump() error {
+func (module *Module) ComponentType() string {
+	return "module"
+}
+
+func (module *Module) Dump(db *sql.DB) error {
 	data, err := yaml.Marshal(module)
 	if err != nil {
 		return err
 	}
-	moduleFilePath := fmt.Sprintf("%s/%s.yaml", modulesDir, module.Slug())
-	return writeYamlFile(moduleFilePath, string(data))
+	return writeYamlFile(db, module.Filepath(), string(data))
+}
+
+func (module *Module) Filepath() string {
+	return fmt.Sprintf("%s/%s.yaml", modulesDir, module.Slug())
 }
 
-func (module *Module) Pull(db *sql.DB) error {
-	return pullComponent(db, modulePath, module.CanvasId, module)
+func (module *Module) GetCanvasId() int {
+	return module.CanvasId
+}
+
+func (module *Module) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, modulePath, module)
 }
 
 func (module *Module) Save(db *sql.DB) error {
 	return meddler.Insert(db, modulesTable, module)
 }
+
+// Gets the items from the same course the module came from so they're dumped
+// along with it. Items and prerequisites are linked to the local components
+// they refer to, so the module can be pushed to any course.
+func (module *Module) pullParts(client *CanvasClient, db *sql.DB, course *Course) error {
+	items, err := getModuleItems(client, course.CanvasId, module.CanvasId)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		if err := items[i].link(db, course); err != nil {
+			return err
+		}
+	}
+	module.Items = items
+
+	if len(module.PrerequisiteModuleIds) == 0 {
+		return nil
+	}
+	modules, err := getModules(client, course)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	for _, m := range modules {
+		names[m.CanvasId] = m.Slug()
+	}
+	module.Prerequisites = make([]string, 0, len(module.PrerequisiteModuleIds))
+	for _, id := range module.PrerequisiteModuleIds {
+		if name, ok := names[id]; ok {
+			module.Prerequisites = append(module.Prerequisites, name)
+		}
+	}
+	return nil
+}
+
+// The items are part of the module's state in Canvas, but they aren't listed
+// with it.
+func (module *Module) listParts(client *CanvasClient, course *Course) (interface{}, error) {
+	return getModuleItems(client, course.CanvasId, module.CanvasId)
+}
+
+// Finds the id of this module in the given course. Uses the id recorded in the
+// db if there is one, otherwise searches the course's modules for one with the
+// same name. Returns 0 if the module doesn't exist in the course yet.
+func (module *Module) findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error) {
+	canvasId, err := findCanvasId(db, module.ComponentType(), module.Slug(), course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	values := url.Values{}
+	values.Add("per_page", "100")
+	values.Add("search_term", module.Name)
+	p := client.newPager(fmt.Sprintf(modulesPath, course.CanvasId), values)
+	var candidates []*Module
+	for p.Next(&candidates) {
+		for _, candidate := range candidates {
+			if candidate.Name == module.Name {
+				return candidate.CanvasId, nil
+			}
+		}
+	}
+	return 0, p.Err()
+}
+
+// Pushes the module and its items to the given courses, creating the module
+// where it doesn't exist yet. Prerequisites and items name local components,
+// which are looked up in each course, so those have to be pushed first.
+func (module *Module) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
+	for _, course := range courses {
+		canvasId, err := module.findCanvasId(client, db, course)
+		if err != nil {
+			return err
+		}
+		m, err := module.payload(client, db, course)
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+
+		pushed := new(Module)
+		canvasId, err = updateOrCreate(client, db, course, module, canvasId, out, func(canvasId int) error {
+			fmt.Fprintf(out, "Updating %s in %s\n", module.Name, course.Name)
+			return client.putObject(fmt.Sprintf(modulePath, course.CanvasId, canvasId), url.Values{}, m, pushed)
+		}, func() error {
+			fmt.Fprintf(out, "Creating %s in %s\n", module.Name, course.Name)
+			return client.postObject(fmt.Sprintf(modulesPath, course.CanvasId), url.Values{}, m, pushed)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+		if canvasId == 0 {
+			canvasId = pushed.CanvasId
+		}
+
+		if module.Items != nil {
+			if canvasId == 0 {
+				// only in a dry run, where nothing was created
+				fmt.Fprintf(out, "  then adding %d item(s)\n", len(module.Items))
+			} else if err := pushModuleItems(client, db, course, canvasId, module.Items, out); err != nil {
+				return fmt.Errorf("failed to push items to %s: %v", course.Name, err)
+			} else if !client.DryRun {
+				// what Canvas returned above still has the old item count
+				if err := client.getObject(fmt.Sprintf(modulePath, course.CanvasId, canvasId), url.Values{}, pushed); err != nil {
+					return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+				}
+			}
+		}
+		if err := recordPush(client, db, course, module, pushed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payload is the module in the form Canvas takes it, with its prerequisites
+// looked up in the given course.
+func (module *Module) payload(client *CanvasClient, db *sql.DB, course *Course) (map[string]interface{}, error) {
+	prerequisites := make([]int, 0, len(module.Prerequisites))
+	for _, name := range module.Prerequisites {
+		canvasId, err := findLinkedId(client, db, course, "module", name, modulesDir, ".yaml", readModuleFile)
+		if err != nil {
+			return nil, fmt.Errorf("prerequisite %s: %v", name, err)
+		}
+		prerequisites = append(prerequisites, canvasId)
+	}
+	return map[string]interface{}{
+		"module": map[string]interface{}{
+			"name":                        module.Name,
+			"position":                    module.Position,
+			"unlock_at":                   module.UnlockAt,
+			"require_sequential_progress": module.RequireSequentialProgress,
+			"prerequisite_module_ids":     prerequisites,
+			"published":                   module.Published,
+		},
+	}, nil
+}
+
+// pushModuleItems makes the items of the module in the given course match the
+// local ones: items are matched up with the ones already in Canvas that link
+// to the same thing and updated, new ones are created, and ones that are no
+// longer in the file are deleted. Every item is given its position from the
+// file, which puts them in the same order.
+func pushModuleItems(client *CanvasClient, db *sql.DB, course *Course, moduleId int, items []ModuleItem, out io.Writer) error {
+	existing, err := getModuleItems(client, course.CanvasId, moduleId)
+	if err != nil {
+		return err
+	}
+	remaining := make(map[int]bool)
+	for _, remote := range existing {
+		remaining[remote.CanvasId] = true
+	}
+
+	// resolve everything before changing anything
+	resolved := make([]*ModuleItem, len(items))
+	remoteIds := make([]int, len(items))
+	for i := range items {
+		if resolved[i], err = items[i].resolve(client, db, course); err != nil {
+			return err
+		}
+		for _, remote := range existing {
+			if remaining[remote.CanvasId] && remote.key() == resolved[i].key() {
+				remoteIds[i] = remote.CanvasId
+				delete(remaining, remote.CanvasId)
+				break
+			}
+		}
+		if remoteIds[i] == 0 && !resolved[i].creatable() {
+			return fmt.Errorf("item %q links to a %s, which %s can't add to a module; add it in Canvas first", items[i].Title, items[i].Type, appName)
+		}
+	}
+
+	// deleting first keeps the positions given below from being shifted
+	for _, remote := range existing {
+		if !remaining[remote.CanvasId] {
+			continue
+		}
+		fmt.Fprintf(out, "  deleting item %q\n", remote.Title)
+		if err := client.deleteObject(fmt.Sprintf(moduleItemPath, course.CanvasId, moduleId, remote.CanvasId), url.Values{}); err != nil {
+			return fmt.Errorf("failed to delete item %q: %v", remote.Title, err)
+		}
+	}
+
+	for i, item := range resolved {
+		payload := map[string]interface{}{
+			"module_item": item.payload(i+1, remoteIds[i] == 0),
+		}
+		if remoteIds[i] > 0 {
+			fmt.Fprintf(out, "  updating item %d\n", i+1)
+			err = client.putObject(fmt.Sprintf(moduleItemPath, course.CanvasId, moduleId, remoteIds[i]), url.Values{}, payload, nil)
+		} else {
+			fmt.Fprintf(out, "  creating item %d\n", i+1)
+			err = client.postObject(fmt.Sprintf(moduleItemsPath, course.CanvasId, moduleId), url.Values{}, payload, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// link records which local component the item links to. Pages are known by
+// their url. Everything else is known by whatever local component was synced
+// with the item's content in this course, since that keeps its local name even
+// if it was renamed in Canvas. Anything easel hasn't seen yet goes by its
+// title, which Canvas keeps the same as the item's.
+func (item *ModuleItem) link(db *sql.DB, course *Course) error {
+	var name *string
+	switch item.Type {
+	case "Page":
+		item.Page = item.PageUrl
+		return nil
+	case "Assignment":
+		name = &item.Assignment
+	case "Quiz":
+		name = &item.Quiz
+	case "Discussion":
+		name = &item.Discussion
+	default:
+		return nil
+	}
+	id, err := findComponentId(db, slug(item.Type), item.ContentId, course)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		id = slug(item.Title)
+	}
+	*name = id
+	return nil
+}
+
+// resolve returns a copy of the item that links to the given course's copy of
+// the local component the item names.
+func (item *ModuleItem) resolve(client *CanvasClient, db *sql.DB, course *Course) (*ModuleItem, error) {
+	resolved := *item
+	var err error
+	switch {
+	case item.Page != "":
+		// page urls are the same in every course
+		resolved.Type, resolved.PageUrl = "Page", item.Page
+	case item.Assignment != "":
+		resolved.Type = "Assignment"
+		resolved.ContentId, err = findLinkedId(client, db, course, "assignment", item.Assignment, assignmentsDir, ".md", readAssignmentFile)
+	case item.Quiz != "":
+		resolved.Type = "Quiz"
+		resolved.ContentId, err = findLinkedId(client, db, course, "quiz", item.Quiz, quizzesDir, ".md", readQuizFile)
+	case item.Discussion != "":
+		resolved.Type = "Discussion"
+		resolved.ContentId, err = findLinkedId(client, db, course, "discussion", item.Discussion, discussionsDir, ".md", readDiscussionFile)
+	case item.Type == "Assignment" || item.Type == "Quiz" || item.Type == "Discussion":
+		return nil, fmt.Errorf("item %q doesn't say which %s it links to; add %s: <name>",
+			item.Title, slug(item.Type), slug(item.Type))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("item %q: %v", item.Title, err)
+	}
+	return &resolved, nil
+}
+
+// key identifies what a resolved item links to, which is how local items are
+// matched up with the items already in a course.
+func (item *ModuleItem) key() string {
+	switch item.Type {
+	case "Page":
+		return "Page " + item.PageUrl
+	case "Assignment", "Quiz", "Discussion":
+		return fmt.Sprintf("%s %d", item.Type, item.ContentId)
+	case "ExternalUrl", "ExternalTool":
+		return item.Type + " " + item.ExternalUrl
+	}
+	return item.Type + " " + item.Title
+}
+
+// creatable reports whether a resolved item has everything Canvas needs to add
+// it to a module. Items that link to things easel doesn't manage, e.g., files
+// or external tools, can only be updated where they already exist.
+func (item *ModuleItem) creatable() bool {
+	switch item.Type {
+	case "Page", "Assignment", "Quiz", "Discussion", "SubHeader", "ExternalUrl":
+		return true
+	}
+	return false
+}
+
+// payload is the resolved item in the form Canvas takes it. What the item
+// links to can only be given when it's created.
+func (item *ModuleItem) payload(position int, create bool) map[string]interface{} {
+	p := map[string]interface{}{
+		"title":     item.Title,
+		"position":  position,
+		"indent":    item.Indent,
+		"new_tab":   item.NewTab,
+		"published": item.Published,
+	}
+	if item.Type == "ExternalUrl" || item.Type == "ExternalTool" {
+		p["external_url"] = item.ExternalUrl
+	}
+	if create {
+		p["type"] = item.Type
+		switch item.Type {
+		case "Page":
+			p["page_url"] = item.PageUrl
+		case "Assignment", "Quiz", "Discussion":
+			p["content_id"] = item.ContentId
+		}
+	}
+	if item.CompletionRequirement.Type != "" {
+		p["completion_requirement"] = map[string]interface{}{
+			"type":      item.CompletionRequirement.Type,
+			"min_score": item.CompletionRequirement.MinScore,
+		}
+	}
+	return p
+}
+
+// canvasIdFinder is implemented by components that can look up their own id in
+// a course.
+type canvasIdFinder interface {
+	findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error)
+}
+
+// findLinkedId finds the id the given course uses for a local component that
+// something else links to by name. Uses the id recorded in the db if there is
+// one, otherwise has the component search the course for itself. It's an error
+// if the component isn't in the course.
+func findLinkedId(client *CanvasClient, db *sql.DB, course *Course, componentType, name, dir, ext string, load func(string) (Component, error)) (int, error) {
+	canvasId, err := findCanvasId(db, componentType, name, course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	filepath := fmt.Sprintf("%s/%s%s", dir, name, ext)
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		return 0, fmt.Errorf("there is no %s %s in %s, and %s does not exist", componentType, name, course.Name, filepath)
+	}
+	component, err := load(filepath)
+	if err != nil {
+		return 0, err
+	}
+	canvasId, err = component.(canvasIdFinder).findCanvasId(client, db, course)
+	if err != nil {
+		return 0, err
+	}
+	if canvasId == 0 {
+		return 0, fmt.Errorf("%s has not been pushed to %s yet", filepath, course.Name)
+	}
+	return canvasId, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oauthAuthPath     = "/login/oauth2/auth"
+	oauthTokenPath    = "/login/oauth2/token"
+	oauthCallbackPath = "/oauth/callback"
+
+	// refresh access tokens a little before Canvas says they expire, so one
+	// doesn't run out between being handed out and being used
+	oauthExpiryMargin = time.Minute
+	oauthLoginTimeout = 5 * time.Minute
+)
+
+// oauthToken is what's stored for a profile that logged in with OAuth, in
+// place of a personal access token. The client secret is kept with it since
+// refreshing needs it.
+type oauthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	ClientSecret string    `json:"client_secret"`
+}
+
+// oauthTokenResponse is Canvas's reply from the token endpoint.
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	User         User   `json:"user"`
+}
+
+// oauthSource hands out access tokens for a profile that logged in with OAuth,
+// refreshing them when they expire and saving the refreshed ones.
+type oauthSource struct {
+	host     string // e.g., https://canvas.example.edu
+	clientId string
+	save     func(*oauthToken) error
+
+	mu    sync.Mutex
+	token *oauthToken
+}
+
+// openBrowser opens the given url in the user's browser. Tests replace it to
+// stand in for the user.
+var openBrowser = func(target string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+	return cmd.Start()
+}
+
+// hostUrl returns the root url of a Canvas host, using https unless the host
+// names a scheme.
+func hostUrl(host string) string {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// oauthLogin runs the OAuth2 authorization code flow: the user approves easel
+// in their browser, Canvas sends them back to a listener on localhost with a
+// code, and the code is traded for tokens.
+func oauthLogin(host, clientId, clientSecret string, port int) (*oauthToken, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the OAuth redirect: %v", err)
+	}
+	redirectUri := fmt.Sprintf("http://localhost:%d%s", listener.Addr().(*net.TCPAddr).Port, oauthCallbackPath)
+
+	state, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != oauthCallbackPath {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		var res result
+		switch {
+		case query.Get("state") != state:
+			res.err = errors.New("the OAuth redirect did not come from this login")
+		case query.Get("error") != "":
+			res.err = fmt.Errorf("Canvas did not authorize easel: %s %s", query.Get("error"), query.Get("error_description"))
+		case query.Get("code") == "":
+			res.err = errors.New("Canvas did not send an authorization code")
+		default:
+			res.code = query.Get("code")
+		}
+		if res.err != nil {
+			fmt.Fprintf(w, "<p>Login failed: %s</p>", html.EscapeString(res.err.Error()))
+		} else {
+			fmt.Fprintf(w, "<p>%s is logged in to Canvas. You can close this window.</p>", appName)
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	params := url.Values{}
+	params.Set("client_id", clientId)
+	params.Set("response_type", "code")
+	params.Set("redirect_uri", redirectUri)
+	params.Set("state", state)
+	authUrl := hostUrl(host) + oauthAuthPath + "?" + params.Encode()
+	fmt.Printf("Opening Canvas in your browser to authorize %s. If it does not open, visit:\n\n    %s\n\n", appName, authUrl)
+	if err := openBrowser(authUrl); err != nil {
+		fmt.Printf("Failed to open a browser: %v\n", err)
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(oauthLoginTimeout):
+		return nil, errors.New("timed out waiting for Canvas to redirect back")
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("client_id", clientId)
+	form.Set("client_secret", clientSecret)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("code", res.code)
+	reply, err := requestOAuthToken(host, form)
+	if err != nil {
+		return nil, err
+	}
+	return &oauthToken{
+		AccessToken:  reply.AccessToken,
+		RefreshToken: reply.RefreshToken,
+		ExpiresAt:    expiresAt(reply.ExpiresIn),
+		ClientSecret: clientSecret,
+	}, nil
+}
+
+// requestOAuthToken posts to Canvas's token endpoint. This goes around the
+// CanvasClient so tokens are never logged or recorded.
+func requestOAuthToken(host string, form url.Values) (*oauthTokenResponse, error) {
+	tokenUrl := hostUrl(host) + oauthTokenPath
+	resp, err := http.PostForm(tokenUrl, form)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", tokenUrl, err)
+	}
+	defer resp.Body.Close()
+	if !isSuccess(resp) {
+		raw, _ := readBody(resp)
+		return nil, newCanvasError("POST", oauthTokenPath, resp, raw)
+	}
+	reply := new(oauthTokenResponse)
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, fmt.Errorf("failed to parse token from server: %v", err)
+	}
+	if reply.AccessToken == "" {
+		return nil, errors.New("Canvas did not send an access token")
+	}
+	return reply, nil
+}
+
+// expiresAt turns Canvas's expires_in into a time. Zero means the token
+// doesn't expire.
+func expiresAt(expiresIn int) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+// newOAuthSource sets up access tokens for a profile that logged in with
+// OAuth, from what storeToken kept for it. Refreshed tokens are stored back in
+// the same place.
+func newOAuthSource(name string, profile *Profile, stored string) (*oauthSource, error) {
+	token := new(oauthToken)
+	if err := json.Unmarshal([]byte(stored), token); err != nil {
+		return nil, fmt.Errorf("corrupt OAuth token for profile %s; try running '%s login --oauth' again", name, os.Args[0])
+	}
+	save := func(token *oauthToken) error {
+		raw, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		rc := mustReadRc()
+		current, ok := rc.Profiles[name]
+		if !ok {
+			return fmt.Errorf("profile %s no longer exists", name)
+		}
+		if err := storeToken(name, current, string(raw)); err != nil {
+			return err
+		}
+		mustWriteRc(rc)
+		return nil
+	}
+	return &oauthSource{host: profile.Host, clientId: profile.ClientId, save: save, token: token}, nil
+}
+
+// accessToken returns a current access token, refreshing it first if it has
+// expired or is about to.
+func (s *oauthSource) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.token.ExpiresAt.IsZero() && time.Now().Add(oauthExpiryMargin).After(s.token.ExpiresAt) {
+		if err := s.refreshLocked(); err != nil {
+			return "", err
+		}
+	}
+	return s.token.AccessToken, nil
+}
+
+// refresh gets a new access token whatever the expiry says, e.g., after Canvas
+// rejects the current one. If another request already refreshed since the
+// rejected token was handed out, that one is used instead.
+func (s *oauthSource) refresh(rejected string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.AccessToken != rejected {
+		return nil
+	}
+	return s.refreshLocked()
+}
+
+func (s *oauthSource) refreshLocked() error {
+	if s.token.RefreshToken == "" {
+		return fmt.Errorf("the access token expired and there is no refresh token; try running '%s login --oauth' again", os.Args[0])
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", s.clientId)
+	form.Set("client_secret", s.token.ClientSecret)
+	form.Set("refresh_token", s.token.RefreshToken)
+	reply, err := requestOAuthToken(s.host, form)
+	if err != nil {
+		return fmt.Errorf("failed to refresh access token: %v", err)
+	}
+
+	token := *s.token
+	token.AccessToken = reply.AccessToken
+	token.ExpiresAt = expiresAt(reply.ExpiresIn)
+	// Canvas keeps the same refresh token unless it sends a new one
+	if reply.RefreshToken != "" {
+		token.RefreshToken = reply.RefreshToken
+	}
+	s.token = &token
+	if s.save != nil {
+		if err := s.save(&token); err != nil {
+			return fmt.Errorf("failed to save refreshed access token: %v", err)
+		}
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
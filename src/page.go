@@ -3,12 +3,10 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/url"
 	"path/filepath"
 
-	"github.com/russross/blackfriday"
 	"gopkg.in/yaml.v2"
 )
 
@@ -19,6 +17,7 @@ const (
 
 type Page struct {
 	Id             int    `json:"-" yaml:"-" meddler:"id,pk"`
+	PageId         int    `json:"page_id" yaml:"-" meddler:"-"` // the canvas id, which differs for each course
 	Url            string `json:"url" yaml:"url" meddler:"url"` // the unique locator for the page, e.g., "my-page-title"
 	Title          string `json:"title" yaml:"title" meddler:"title" `
 	CreatedAt      string `json:"created_at" yaml:"created_at" meddler:"created_at" `
@@ -31,16 +30,13 @@ type Page struct {
 	NotifyOfUpdate bool   `json:"notify_of_update" yaml:"-" meddler:"-"`
 }
 
-func getPages(db *sql.DB) []*Page {
+func getPages(client *CanvasClient, course *Course) ([]*Page, error) {
 	pages := make([]*Page, 0)
-	courses, _ := findCourses(db)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	reqUrl := fmt.Sprintf(pagesPath, courseId)
-	mustGetObject(reqUrl, values, &pages)
-	return pages
+	reqUrl := fmt.Sprintf(pagesPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &pages)
+	return pages, err
 }
 
 func getPageUrlFromFilepath(pagefilepath string) string {
@@ -49,26 +45,51 @@ func getPageUrlFromFilepath(pagefilepath string) string {
 	return basename[:len(basename)-len(ext)] // remove extension
 }
 
-func loadPage(db *sql.DB, pageUrl string) *Page {
+func loadPage(db *sql.DB, pageUrl string) (*Page, error) {
+	page, err := readPageFile(fmt.Sprintf("%s/%s.md", pagesDir, pageUrl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load page %s: %v", pageUrl, err)
+	}
+	return page.(*Page), nil
+}
+
+func readPageFile(filepath string) (Component, error) {
 	page := new(Page)
-	body, err := readFile(fmt.Sprintf("%s/%s.md", pagesDir, pageUrl), page)
+	body, err := readFile(filepath, page)
 	if err != nil {
-		log.Fatalf("Failed to load page %s\n", pageUrl)
+		return page, err
 	}
 	page.Body = body
-	return page
+	if page.Url == "" {
+		page.Url = getPageUrlFromFilepath(filepath)
+	}
+	return page, nil
 }
 
-func pullPages(db *sql.DB) {
-	pages := getPages(db)
+func listPages(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	pages, err := getPages(client, course)
 	for _, page := range pages {
-		page.Pull(db)
+		components = append(components, page)
+	}
+	return components, err
+}
+
+func pullPages(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listPages, pagePath)
+}
+
+func pushPage(client *CanvasClient, db *sql.DB, courses []*Course, pageUrl string, out io.Writer) error {
+	page, err := loadPage(db, pageUrl)
+	if err != nil {
+		return err
 	}
+	return page.Push(client, db, courses, out)
 }
 
-func pushPage(db *sql.DB, pageUrl string) {
-	page := loadPage(db, pageUrl)
-	bodyHtml := string(blackfriday.MarkdownCommon([]byte(page.Body)))
+func (page *Page) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
+	pageUrl := page.Url
+	bodyHtml := renderMarkdown(page.Body)
 	// Using a map here because Canvas doesn't like it when we PUT with fields
 	// such as CreatedAt and I can't figure out how to remove them only for
 	// marshaling.
@@ -83,35 +104,49 @@ func pushPage(db *sql.DB, pageUrl string) {
 			"todo_date":        page.TodoDate, // TODO: canvas not accepting this for some reason
 		},
 	}
-	courses, _ := findCourses(db)
 	for _, course := range courses {
 		courseId := course.CanvasId
 		pageFullPath := fmt.Sprintf(pagePath, courseId, pageUrl)
-		fmt.Printf("Pushing page %s to %s\n", pageUrl, course.Name)
-		mustPutObject(pageFullPath, url.Values{}, wikiPage, nil)
+		fmt.Fprintf(out, "Pushing page %s to %s\n", pageUrl, course.Name)
+		pushed := new(Page)
+		if err := client.putObject(pageFullPath, url.Values{}, wikiPage, pushed); err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+		if err := recordPush(client, db, course, page, pushed); err != nil {
+			return fmt.Errorf("failed to record canvas id in %s: %v", course.Name, err)
+		}
 	}
+	return nil
 }
 
-func pushPages(db *sql.DB) {
-	files, err := ioutil.ReadDir(pagesDir)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for _, f := range files {
-		pushPage(db, getPageUrlFromFilepath(f.Name()))
-	}
+func (page *Page) ComponentType() string {
+	return "page"
 }
 
-func (page *Page) Dump() error {
+func (page *Page) Dump(db *sql.DB) error {
 	metadata, err := yaml.Marshal(page)
 	if err != nil {
 		return err
 	}
-	pageFilePath := fmt.Sprintf("%s/%s.md", pagesDir, page.Url)
-	return writeFile(pageFilePath, string(metadata), page.Body)
+	return writeFile(db, page.Filepath(), string(metadata), page.Body)
+}
+
+func (page *Page) htmlBody() string {
+	return page.Body
+}
+
+func (page *Page) Filepath() string {
+	return fmt.Sprintf("%s/%s.md", pagesDir, page.Url)
+}
+
+func (page *Page) GetCanvasId() int {
+	return page.PageId
+}
+
+func (page *Page) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, pagePath, page)
 }
 
-func (page *Page) Pull(db *sql.DB) error {
-	return pullComponent(db, pagePath, page.Url, page)
+func (page *Page) Slug() string {
+	return page.Url
 }
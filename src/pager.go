@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+
+	"github.com/deiu/linkparser"
+)
+
+// pager steps through a listing from Canvas a page at a time, following the
+// next links Canvas sends in the Link header. Each page is decoded straight
+// into the caller's slice, so a long listing never has to be held all at once:
+//
+//	p := client.newPager(path, params)
+//	var page []*Assignment
+//	for p.Next(&page) {
+//		// use page
+//	}
+//	if err := p.Err(); err != nil {
+//		// handle err
+//	}
+type pager struct {
+	client *CanvasClient
+	path   string // the path of the listing, for errors
+	reqUrl string // the next page to get, or "" when there are no more
+	params url.Values
+	err    error
+}
+
+func (c *CanvasClient) newPager(path string, params url.Values) *pager {
+	return &pager{
+		client: c,
+		path:   path,
+		reqUrl: c.BaseUrl + path,
+		params: params,
+	}
+}
+
+// Next gets the next page into page, which must point to a slice. Whatever was
+// in the slice is replaced. Returns false when there are no more pages or a
+// request fails, which Err reports.
+func (p *pager) Next(page interface{}) bool {
+	if p.reqUrl == "" || p.err != nil {
+		return false
+	}
+
+	// start from a fresh slice so items from an earlier page, which the caller
+	// may have kept, aren't decoded over
+	slice := reflect.ValueOf(page).Elem()
+	slice.Set(reflect.Zero(slice.Type()))
+
+	resp, err := p.client.sendRequest(p.reqUrl, p.params, "GET", nil, page)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	defer resp.Body.Close()
+	if !isSuccess(resp) {
+		p.err = p.client.newCanvasError("GET", p.path, resp)
+		return false
+	}
+	if err := p.client.parseResponse(resp, page); err != nil {
+		p.err = err
+		return false
+	}
+
+	// the next link already carries the query parameters
+	p.reqUrl = lh.ParseHeader(resp.Header.Get("Link"))["next"]["href"]
+	p.params = nil
+	return true
+}
+
+// Err returns the error that stopped the pager, if any.
+func (p *pager) Err() error {
+	return p.err
+}
+
+// getList gets every page of a listing into list, which must point to a slice.
+func (c *CanvasClient) getList(path string, params url.Values, list interface{}) error {
+	all := reflect.ValueOf(list).Elem()
+	page := reflect.New(all.Type())
+	p := c.newPager(path, params)
+	for p.Next(page.Interface()) {
+		all.Set(reflect.AppendSlice(all, page.Elem()))
+	}
+	return p.Err()
+}
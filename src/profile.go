@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+const (
+	defaultProfile = "default"
+	profileEnv     = "EASEL_PROFILE"
+)
+
+// Profile is a Canvas instance the user has logged in to. The token is kept
+// somewhere safer than the config file, see storeToken.
+type Profile struct {
+	Host       string `json:"host"`
+	TokenStore string `json:"token_store,omitempty"`
+	Token      string `json:"token,omitempty"`     // only in logins from before tokens were stored elsewhere
+	ClientId   string `json:"client_id,omitempty"` // the developer key, for profiles that logged in with OAuth
+}
+
+// rcFile is the user's config file, holding a profile for each Canvas instance
+// they use.
+type rcFile struct {
+	Default  string              `json:"default"`
+	Profiles map[string]*Profile `json:"profiles"`
+
+	// the single login kept by versions before profiles
+	Host  string `json:"host,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// activeProfile returns the name of the profile to use and where that choice
+// came from. In order, it is the one named by --profile, the one named by
+// $EASEL_PROFILE, the one pinned to this directory, and then the user's
+// default.
+func activeProfile(rc *rcFile) (string, string) {
+	if Config.profile != "" {
+		return Config.profile, "--profile"
+	}
+	if name := os.Getenv(profileEnv); name != "" {
+		return name, "$" + profileEnv
+	}
+	if name := pinnedProfile(); name != "" {
+		return name, easelDb
+	}
+	return rc.Default, perUserDotFile
+}
+
+// pinnedProfile returns the profile pinned to the courses in this directory, if
+// any. Every command looks for one, including commands like login that don't
+// otherwise touch the db, so the db is only read, never upgraded. A db that
+// can't be read, e.g., one from before profiles could be pinned, has nothing
+// pinned.
+func pinnedProfile() string {
+	path, err := findDbPath()
+	if err != nil {
+		return ""
+	}
+	dsn := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return ""
+	}
+	defer db.Close()
+	name, err := getSetting(db, profileSetting)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// profileUsage is the hint shown when a profile name doesn't match any profile.
+func profileUsage(name string) string {
+	return fmt.Sprintf("No profile named %s; run '%s profile list' to see them", name, os.Args[0])
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/russross/meddler"
+)
+
+// the kinds of components push --prune deletes, in the order it deletes them.
+// Groups go last, since Canvas deletes the assignments in a group along with
+// it and a group is only deleted once it's empty.
+var pruneOrder = []string{"modules", "pages", "discussions", "quizzes", "assignments", "assignment_groups"}
+
+// A component that was synced with a course but has since been deleted locally
+type prunable struct {
+	kind    componentKind
+	course  *Course
+	mapping *ComponentCanvasId
+}
+
+// findPrunable lists the components of the given kinds that were pulled from
+// or pushed to the given courses but whose local files are gone. Components
+// that easel has only seen listed in Canvas, and never synced, are left out,
+// and so are components that a local file still claims, e.g., because it was
+// renamed locally and so has a new file name.
+func findPrunable(client *CanvasClient, db *sql.DB, courses []*Course, kinds []componentKind) ([]prunable, error) {
+	selected := make(map[string]bool)
+	for _, kind := range kinds {
+		selected[kind.name] = true
+	}
+
+	pruned := make([]prunable, 0)
+	for _, name := range pruneOrder {
+		kind, _ := findComponentKind(name)
+		if !selected[kind.name] {
+			continue
+		}
+		locals, err := kind.loadComponents()
+		if err != nil {
+			return pruned, err
+		}
+		local := make(map[string]bool)
+		for _, component := range locals {
+			local[component.Slug()] = true
+			// the id in the file is the one from the course it was pulled from,
+			// so if that id was recorded under another name, the component was
+			// renamed locally and that name is still in use
+			renamed, err := idsWithCanvasId(db, kind.componentType, component.GetCanvasId())
+			if err != nil {
+				return pruned, err
+			}
+			for _, componentId := range renamed {
+				local[componentId] = true
+			}
+		}
+
+		for _, course := range courses {
+			var mappings []*ComponentCanvasId
+			err := meddler.QueryAll(db, &mappings, "SELECT * FROM "+componentCanvasIdsTable+
+				" WHERE component_type = ? AND course_id = ? ORDER BY component_id", kind.componentType, course.Id)
+			if err != nil {
+				return pruned, err
+			}
+			var claimed map[int]bool
+			for _, mapping := range mappings {
+				if local[mapping.ComponentId] || mapping.RemoteHash == "" {
+					continue
+				}
+				if claimed == nil {
+					if claimed, err = claimedIds(client, db, course, locals); err != nil {
+						return pruned, err
+					}
+				}
+				if claimed[mapping.CanvasId] {
+					continue
+				}
+				pruned = append(pruned, prunable{kind, course, mapping})
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// idsWithCanvasId lists the local ids recorded for the component with the given
+// Canvas id, in any course.
+func idsWithCanvasId(db *sql.DB, componentType string, canvasId int) ([]string, error) {
+	ids := make([]string, 0)
+	if canvasId == 0 {
+		return ids, nil
+	}
+	rows, err := db.Query("SELECT component_id FROM "+componentCanvasIdsTable+
+		" WHERE component_type = ? AND canvas_id = ?", componentType, canvasId)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// claimedIds finds the Canvas ids of the given local components in the course,
+// the same way pushing them would.
+func claimedIds(client *CanvasClient, db *sql.DB, course *Course, locals []Component) (map[int]bool, error) {
+	claimed := make(map[int]bool)
+	for _, component := range locals {
+		var canvasId int
+		var err error
+		if finder, ok := component.(canvasIdFinder); ok {
+			canvasId, err = finder.findCanvasId(client, db, course)
+		} else {
+			canvasId, err = findCanvasId(db, component.ComponentType(), component.Slug(), course)
+		}
+		if err != nil {
+			return claimed, err
+		}
+		if canvasId > 0 {
+			claimed[canvasId] = true
+		}
+	}
+	return claimed, nil
+}
+
+// pruneComponents deletes the components of the given kinds from Canvas whose
+// local files were deleted, after listing them and asking first (unless --yes
+// was given). A dry run just lists them along with the requests it would make.
+// Assignments and quizzes that students have submitted to are only deleted with
+// --force.
+func pruneComponents(client *CanvasClient, db *sql.DB, courses []*Course, kinds []componentKind) error {
+	found, err := findPrunable(client, db, courses, kinds)
+	if err != nil {
+		return err
+	}
+	pruned := make([]prunable, 0, len(found))
+	for _, p := range found {
+		if !Config.force {
+			submitted, err := hasSubmissions(client, p)
+			if err == nil && submitted {
+				err = errors.New("students have submitted to it; use --force to delete it anyway")
+			}
+			if err != nil {
+				recordFailure(fmt.Sprintf("delete %s %s from %s", p.kind.componentType, p.mapping.ComponentId, p.course.Name), err)
+				continue
+			}
+		}
+		pruned = append(pruned, p)
+	}
+	if len(pruned) == 0 {
+		fmt.Println("Nothing to prune")
+		return nil
+	}
+
+	fmt.Println("Deleted locally, so these will be deleted from Canvas:")
+	for _, p := range pruned {
+		fmt.Printf("  %-18s%-32s%s\n", p.kind.componentType, p.mapping.ComponentId, p.course.Name)
+	}
+	if !client.DryRun && !Config.yes {
+		ok, err := confirm(fmt.Sprintf("Delete %d component(s) from Canvas? [y/N] ", len(pruned)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Nothing was deleted")
+			return nil
+		}
+	}
+
+	// assignments that are about to be deleted don't keep their group in use
+	leaving := make(map[string]bool)
+	for _, p := range pruned {
+		if p.kind.componentType == "assignment" {
+			leaving[fmt.Sprintf("%d/%d", p.course.Id, p.mapping.CanvasId)] = true
+		}
+	}
+
+	for _, p := range pruned {
+		description := fmt.Sprintf("%s %s from %s", p.kind.componentType, p.mapping.ComponentId, p.course.Name)
+		if p.kind.componentType == "assignment_group" {
+			inUse, err := groupInUse(client, p.course, p.mapping.CanvasId, leaving)
+			if err == nil && inUse {
+				err = errors.New("it still has assignments in it; move them to another group first")
+			}
+			if err != nil {
+				recordFailure("delete "+description, err)
+				continue
+			}
+		}
+
+		var id interface{} = p.mapping.CanvasId
+		if p.kind.componentType == "page" {
+			// pages are addressed by their url
+			id = p.mapping.ComponentId
+		}
+		err := client.deleteObject(fmt.Sprintf(p.kind.path, p.course.CanvasId, id), url.Values{})
+		if err != nil && !isNotFound(err) {
+			recordFailure("delete "+description, err)
+			continue
+		}
+		if client.DryRun {
+			continue
+		}
+		fmt.Printf("Deleted %s\n", description)
+		if err := forgetComponent(db, p.course, p.mapping); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasSubmissions reports whether any students have submitted to the assignment
+// or quiz, which deleting it would throw away. Other components don't take
+// submissions.
+func hasSubmissions(client *CanvasClient, p prunable) (bool, error) {
+	var err error
+	submitted := false
+	switch p.kind.componentType {
+	case "assignment":
+		var assignment struct {
+			HasSubmittedSubmissions bool `json:"has_submitted_submissions"`
+		}
+		err = client.getObject(fmt.Sprintf(assignmentPath, p.course.CanvasId, p.mapping.CanvasId), url.Values{}, &assignment)
+		submitted = assignment.HasSubmittedSubmissions
+	case "quiz":
+		var submissions struct {
+			QuizSubmissions []struct {
+				Id int `json:"id"`
+			} `json:"quiz_submissions"`
+		}
+		values := url.Values{}
+		values.Add("per_page", "1")
+		err = client.getObject(fmt.Sprintf(quizSubmissionsPath, p.course.CanvasId, p.mapping.CanvasId), values, &submissions)
+		submitted = len(submissions.QuizSubmissions) > 0
+	}
+	if isNotFound(err) {
+		// already gone, so there's nothing to lose
+		return false, nil
+	}
+	return submitted, err
+}
+
+// groupInUse reports whether any assignments in the course, other than the
+// ones that are leaving, are in the given group.
+func groupInUse(client *CanvasClient, course *Course, groupId int, leaving map[string]bool) (bool, error) {
+	assignments, err := getAssignments(client, course)
+	if err != nil {
+		return false, err
+	}
+	for _, assignment := range assignments {
+		if assignment.AssignmentGroupId == groupId && !leaving[fmt.Sprintf("%d/%d", course.Id, assignment.CanvasId)] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// forgetComponent drops what was recorded about a component that was deleted
+// from the course, including the ids of its quiz questions.
+func forgetComponent(db *sql.DB, course *Course, mapping *ComponentCanvasId) error {
+	if _, err := db.Exec("DELETE FROM "+componentCanvasIdsTable+" WHERE id = ?", mapping.Id); err != nil {
+		return err
+	}
+	if mapping.ComponentType != "quiz" {
+		return nil
+	}
+	_, err := db.Exec("DELETE FROM "+componentCanvasIdsTable+
+		" WHERE component_type = 'quiz_question' AND course_id = ? AND component_id LIKE ?",
+		course.Id, mapping.ComponentId+"/%")
+	return err
+}
+
+// confirm asks a yes or no question. Anything but yes is taken as no.
+func confirm(prompt string) (bool, error) {
+	fmt.Print(prompt)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return false, errors.New("no answer; use --yes when not running interactively")
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -33,6 +38,7 @@ type Quiz struct {
 	UnlockAt           string  `json:"unlock_at" yaml:"unlock_at" meddler:"unlock_at"`
 	Published          bool    `json:"published" yaml:"published" meddler:"published"`
 	AssignmentGroupId  int     `json:"assignment_group_id" yaml:"assignment_group_id" meddler:"assignment_group_id"` // the ID of the quiz's assignment group:
+	AssignmentGroup    string  `json:"-" yaml:"assignment_group,omitempty" meddler:"-"`                              // the local name of the quiz's assignment group, which is what gets pushed
 
 	// how many times a student can take the quiz (-1 = unlimited attempts)
 	AllowedAttempts int `json:"allowed_attempts" yaml:"allowed_attempts" meddler:"allowed_attempts"`
@@ -80,37 +86,69 @@ type Quiz struct {
 	QuizQuestions        []*QuizQuestion `json:"-" yaml:"-" meddler:"-"`
 }
 
-func getQuizzes(db *sql.DB) []*Quiz {
+func getQuizzes(client *CanvasClient, course *Course) ([]*Quiz, error) {
 	quizzes := make([]*Quiz, 0)
-	courses, _ := findCourses(db)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	// TODO: do it for all courses
-	courseId := courses[0].CanvasId
-	reqUrl := fmt.Sprintf(quizzesPath, courseId)
-	mustGetObject(reqUrl, values, &quizzes)
-	// get the quiz's questions while we're here
-	for _, quiz := range quizzes {
-		quiz.QuizQuestions = getQuizQuestions(courseId, quiz.CanvasId)
+	reqUrl := fmt.Sprintf(quizzesPath, course.CanvasId)
+	err := client.getList(reqUrl, values, &quizzes)
+	return quizzes, err
+}
+
+func readQuizFile(filepath string) (Component, error) {
+	quiz := new(Quiz)
+	description, err := readFile(filepath, quiz)
+	quiz.Description = description
+	return quiz, err
+}
+
+// readQuizQuestions reads the questions that go with the quiz. Returns nil if
+// the quiz has no questions file, so its questions are left alone.
+func (quiz *Quiz) readQuizQuestions() ([]*QuizQuestion, error) {
+	qqs := make([]*QuizQuestion, 0)
+	err := readYamlFile(quiz.questionsFilepath(), &qqs)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return qqs, err
+}
+
+func pushQuiz(client *CanvasClient, db *sql.DB, courses []*Course, filepath string, out io.Writer) error {
+	// the questions are pushed along with their quiz
+	if strings.HasSuffix(filepath, quizQuestionsSuffix+".md") {
+		filepath = strings.TrimSuffix(filepath, quizQuestionsSuffix+".md") + ".md"
 	}
-	return quizzes
+	quiz, err := readQuizFile(filepath)
+	if err != nil {
+		return err
+	}
+	return quiz.(*Quiz).Push(client, db, courses, out)
 }
 
-func pullQuizzes(db *sql.DB) {
-	quizzes := getQuizzes(db)
+func listQuizzes(client *CanvasClient, course *Course) ([]Component, error) {
+	components := make([]Component, 0)
+	quizzes, err := getQuizzes(client, course)
 	for _, quiz := range quizzes {
-		quiz.Dump()
+		components = append(components, quiz)
 	}
+	return components, err
+}
+
+func pullQuizzes(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponents(client, db, courses, listQuizzes, quizPath)
+}
+
+func (quiz *Quiz) ComponentType() string {
+	return "quiz"
 }
 
-func (quiz *Quiz) Dump() error {
+func (quiz *Quiz) Dump(db *sql.DB) error {
 	metadata, err := yaml.Marshal(quiz)
 	if err != nil {
 		return err
 	}
 
-	quizFilePath := fmt.Sprintf("%s/%s.md", quizzesDir, quiz.Slug())
-	err = writeFile(quizFilePath, string(metadata), quiz.Description)
+	err = writeFile(db, quiz.Filepath(), string(metadata), quiz.Description)
 	if err != nil {
 		return err
 	}
@@ -120,17 +158,189 @@ func (quiz *Quiz) Dump() error {
 	if err != nil {
 		return err
 	}
-	quizQuestionsFilePath := fmt.Sprintf("%s/%s%s.md", quizzesDir, quiz.Slug(), quizQuestionsSuffix)
-	return writeYamlFile(quizQuestionsFilePath, string(qqs))
+	return writeYamlFile(db, quiz.questionsFilepath(), string(qqs))
+}
+
+func (quiz *Quiz) htmlBody() string {
+	return quiz.Description
+}
+
+func (quiz *Quiz) Filepath() string {
+	return fmt.Sprintf("%s/%s.md", quizzesDir, quiz.Slug())
+}
+
+func (quiz *Quiz) questionsFilepath() string {
+	return fmt.Sprintf("%s/%s%s.md", quizzesDir, quiz.Slug(), quizQuestionsSuffix)
+}
+
+func (quiz *Quiz) GetCanvasId() int {
+	return quiz.CanvasId
+}
+
+func (quiz *Quiz) Pull(client *CanvasClient, db *sql.DB, courses []*Course) error {
+	return pullComponent(client, db, courses, quizPath, quiz)
+}
+
+// Finds the id of this quiz in the given course. Uses the id recorded in the db
+// if there is one, otherwise searches the course's quizzes for one with the same
+// title. Returns 0 if the quiz doesn't exist in the course yet.
+func (quiz *Quiz) findCanvasId(client *CanvasClient, db *sql.DB, course *Course) (int, error) {
+	canvasId, err := findCanvasId(db, quiz.ComponentType(), quiz.Slug(), course)
+	if err != nil || canvasId > 0 {
+		return canvasId, err
+	}
+
+	values := url.Values{}
+	values.Add("per_page", "100")
+	values.Add("search_term", quiz.Title)
+	p := client.newPager(fmt.Sprintf(quizzesPath, course.CanvasId), values)
+	var candidates []*Quiz
+	for p.Next(&candidates) {
+		for _, candidate := range candidates {
+			if candidate.Title == quiz.Title {
+				return candidate.CanvasId, nil
+			}
+		}
+	}
+	return 0, p.Err()
+}
+
+// Pushes the quiz and its questions to the given courses. A quiz that doesn't
+// exist in a course yet is created first so it has somewhere to put the
+// questions. Once the questions match the local file, the quiz itself is
+// updated, which is also what makes Canvas show students the new questions of
+// a published quiz.
+func (quiz *Quiz) Push(client *CanvasClient, db *sql.DB, courses []*Course, out io.Writer) error {
+	questions, err := quiz.readQuizQuestions()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", quiz.questionsFilepath(), err)
+	}
+
+	marshalled, err := json.Marshal(quiz)
+	if err != nil {
+		return err
+	}
+	var quizMap map[string]interface{}
+	if err := json.Unmarshal(marshalled, &quizMap); err != nil {
+		return err
+	}
+	quizMap["description"] = renderMarkdown(quiz.Description)
+	// assignment_group_id is looked up in each course, since every course has
+	// its own ids
+	invalidFields := []string{"id", "html_url", "preview_url", "question_count",
+		"points_possible", "assignment_group_id"}
+	for _, field := range invalidFields {
+		delete(quizMap, field)
+	}
+	q := map[string]interface{}{
+		"quiz": quizMap,
+	}
+
+	for i, course := range courses {
+		canvasId, err := quiz.findCanvasId(client, db, course)
+		if err != nil {
+			return err
+		}
+		if quiz.AssignmentGroup != "" {
+			groupId, err := findAssignmentGroupId(client, db, course, quiz.AssignmentGroup)
+			if err != nil {
+				return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+			}
+			quizMap["assignment_group_id"] = groupId
+		}
+
+		pushed := new(Quiz)
+		// the quiz is saved after its questions are pushed, which is what shows
+		// students the new versions of them
+		pushQuestions := func(canvasId int) error {
+			if questions == nil {
+				return nil
+			}
+			if canvasId == 0 {
+				// only in a dry run, where nothing was created
+				fmt.Fprintf(out, "  then adding %d question(s)\n", len(questions))
+				return nil
+			}
+			return pushQuizQuestions(client, db, course, quiz, canvasId, questions, out)
+		}
+		save := func(canvasId int) error {
+			if canvasId == 0 {
+				return nil
+			}
+			fmt.Fprintf(out, "Updating %s in %s\n", quiz.Title, course.Name)
+			return client.putObject(fmt.Sprintf(quizPath, course.CanvasId, canvasId), url.Values{}, q, pushed)
+		}
+		_, err = updateOrCreate(client, db, course, quiz, canvasId, out, func(canvasId int) error {
+			if err := pushQuestions(canvasId); err != nil {
+				return err
+			}
+			return save(canvasId)
+		}, func() error {
+			fmt.Fprintf(out, "Creating %s in %s\n", quiz.Title, course.Name)
+			if err := client.postObject(fmt.Sprintf(quizzesPath, course.CanvasId), url.Values{}, q, pushed); err != nil {
+				return err
+			}
+			if err := pushQuestions(pushed.CanvasId); err != nil {
+				return err
+			}
+			return save(pushed.CanvasId)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push to %s: %v", course.Name, err)
+		}
+
+		// questions that are new locally take their ids from the first course,
+		// which gives them an identity to find them by later
+		if questions != nil && i == 0 && !client.DryRun {
+			if err := quiz.saveQuestionIds(questions); err != nil {
+				return err
+			}
+		}
+		if err := recordPush(client, db, course, quiz, pushed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveQuestionIds writes the questions file back out if any question didn't
+// have an id before it was pushed. The file is about to be recorded as synced,
+// so it's written as is rather than merged.
+func (quiz *Quiz) saveQuestionIds(questions []*QuizQuestion) error {
+	changed := false
+	for _, qq := range questions {
+		changed = changed || qq.assignedId
+	}
+	if !changed {
+		return nil
+	}
+	qqs, err := yaml.Marshal(questions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(quiz.questionsFilepath(), qqs, 0644)
+}
+
+// Gets the questions from the same course the quiz came from so they're dumped
+// along with it, and the name of the quiz's assignment group so it can be put
+// in the same group in every course.
+func (quiz *Quiz) pullParts(client *CanvasClient, db *sql.DB, course *Course) error {
+	qqs, err := getQuizQuestions(client, course.CanvasId, quiz.CanvasId)
+	if err != nil {
+		return err
+	}
+	quiz.QuizQuestions = qqs
+	if quiz.AssignmentGroupId == 0 {
+		return nil
+	}
+	quiz.AssignmentGroup, err = assignmentGroupSlug(client, course, quiz.AssignmentGroupId)
+	return err
 }
 
-func (quiz *Quiz) Pull(db *sql.DB) error {
-	// get the quiz questions
-	courses, _ := findCourses(db)
-	courseId := courses[0].CanvasId
-	quiz.QuizQuestions = getQuizQuestions(courseId, quiz.CanvasId)
-	// pull the quiz and then dump it and its questions
-	return pullComponent(db, quizPath, quiz.CanvasId, quiz)
+// The questions are part of the quiz's state in Canvas, but they aren't listed
+// with it.
+func (quiz *Quiz) listParts(client *CanvasClient, course *Course) (interface{}, error) {
+	return getQuizQuestions(client, course.CanvasId, quiz.CanvasId)
 }
 
 func (quiz *Quiz) Slug() string {
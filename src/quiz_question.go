@@ -2,9 +2,12 @@ package main
 
 import (
 	// "encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"strings"
 )
 
 const (
@@ -28,6 +31,8 @@ type QuizQuestion struct {
 	Matches           []map[string]interface{} `json:"matches" yaml:"matches" meddler:"matches"`                                  // The possible matches for matching_question types
 	// Answers           []*QuizAnswer      `json:"answers" yaml:"answers" meddler:"answers"`                                  // An array of available answers to display to the student.
 	// Matches           []*QuizAnswerMatch `json:"matches" yaml:"matches" meddler:"matches"`                                  // The possible matches for matching_question types
+
+	assignedId bool // whether CanvasId was just assigned by pushing a new question
 }
 
 type QuizAnswer struct {
@@ -46,13 +51,177 @@ type QuizAnswerMatch struct {
 	Text     string `json:"text" yaml:"text" meddler:"text"`
 }
 
-func getQuizQuestions(courseId, quizId int) []*QuizQuestion {
+func getQuizQuestions(client *CanvasClient, courseId, quizId int) ([]*QuizQuestion, error) {
 	qqs := make([]*QuizQuestion, 0)
 	reqUrl := fmt.Sprintf(quizQuestionsPath, courseId, quizId)
 	values := url.Values{}
 	values.Add("per_page", "100")
-	mustGetObject(reqUrl, values, &qqs)
-	return qqs
+	err := client.getList(reqUrl, values, &qqs)
+	return qqs, err
+}
+
+// Canvas returns answers with different field names than it takes them in
+var quizAnswerFields = map[string]string{
+	"text":          "answer_text",
+	"html":          "answer_html",
+	"weight":        "answer_weight",
+	"comments":      "answer_comments",
+	"comments_html": "answer_comments_html",
+	"left":          "answer_match_left",
+	"right":         "answer_match_right",
+}
+
+// quizQuestionId is how a question is tracked in the db: the quiz it belongs to
+// and its id in the local file, which is the id from the course it was pulled
+// from or first pushed to.
+func quizQuestionId(quiz *Quiz, qq *QuizQuestion) string {
+	return fmt.Sprintf("%s/%d", quiz.Slug(), qq.CanvasId)
+}
+
+// pushQuizQuestions makes the questions of the quiz in the given course match
+// the local ones: questions are matched up with the ones already in Canvas and
+// updated, new ones are created, ones that are no longer in the file are
+// deleted, and then the questions are put in the same order as the file.
+func pushQuizQuestions(client *CanvasClient, db *sql.DB, course *Course, quiz *Quiz, quizId int, questions []*QuizQuestion, out io.Writer) error {
+	existing, err := getQuizQuestions(client, course.CanvasId, quizId)
+	if err != nil {
+		return err
+	}
+	remaining := make(map[int]*QuizQuestion)
+	for _, remote := range existing {
+		remaining[remote.CanvasId] = remote
+	}
+
+	order := make([]map[string]interface{}, 0, len(questions))
+	for i, qq := range questions {
+		remoteId, err := qq.findCanvasId(db, course, quiz, existing, remaining)
+		if err != nil {
+			return err
+		}
+		delete(remaining, remoteId)
+
+		payload := map[string]interface{}{
+			"question": qq.payload(i + 1),
+		}
+		pushed := new(QuizQuestion)
+		if remoteId > 0 {
+			fmt.Fprintf(out, "  updating question %d\n", i+1)
+			err = client.putObject(fmt.Sprintf(quizQuestionPath, course.CanvasId, quizId, remoteId), url.Values{}, payload, pushed)
+		} else {
+			fmt.Fprintf(out, "  creating question %d\n", i+1)
+			err = client.postObject(fmt.Sprintf(quizQuestionsPath, course.CanvasId, quizId), url.Values{}, payload, pushed)
+		}
+		if err != nil {
+			return fmt.Errorf("question %d: %v", i+1, err)
+		}
+		if client.DryRun {
+			continue
+		}
+		if qq.CanvasId == 0 {
+			qq.CanvasId = pushed.CanvasId
+			qq.assignedId = true
+		}
+		if err := saveCanvasId(db, "quiz_question", quizQuestionId(quiz, qq), course, pushed.CanvasId); err != nil {
+			return err
+		}
+		order = append(order, map[string]interface{}{"type": "question", "id": pushed.CanvasId})
+	}
+
+	for _, remote := range existing {
+		if _, ok := remaining[remote.CanvasId]; !ok {
+			continue
+		}
+		fmt.Fprintf(out, "  deleting question %q\n", remote.QuestionName)
+		if err := client.deleteObject(fmt.Sprintf(quizQuestionPath, course.CanvasId, quizId, remote.CanvasId), url.Values{}); err != nil {
+			return fmt.Errorf("failed to delete question %q: %v", remote.QuestionName, err)
+		}
+	}
+
+	if len(order) == 0 {
+		return nil
+	}
+	return client.postObject(fmt.Sprintf(quizReorderPath, course.CanvasId, quizId), url.Values{},
+		map[string]interface{}{"order": order}, nil)
+}
+
+// findCanvasId finds the question among the ones in the course that haven't
+// been matched yet (remaining, out of all the existing ones). In the course its
+// id came from, that's the question with the same id; elsewhere it's the one
+// recorded when it was last pushed there. Otherwise a question with the same
+// name and text is taken to be the same one, e.g., in a course that was copied
+// from another. Returns 0 if there's no match.
+func (qq *QuizQuestion) findCanvasId(db *sql.DB, course *Course, quiz *Quiz, existing []*QuizQuestion, remaining map[int]*QuizQuestion) (int, error) {
+	if qq.CanvasId > 0 {
+		if _, ok := remaining[qq.CanvasId]; ok {
+			return qq.CanvasId, nil
+		}
+		canvasId, err := findCanvasId(db, "quiz_question", quizQuestionId(quiz, qq), course)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := remaining[canvasId]; ok {
+			return canvasId, nil
+		}
+	}
+	for _, remote := range existing {
+		if _, ok := remaining[remote.CanvasId]; ok && remote.QuestionName == qq.QuestionName && remote.QuestionText == qq.QuestionText {
+			return remote.CanvasId, nil
+		}
+	}
+	return 0, nil
+}
+
+// payload is the question in the form Canvas takes it.
+func (qq *QuizQuestion) payload(position int) map[string]interface{} {
+	answers := make([]map[string]interface{}, 0, len(qq.Answers))
+	for _, answer := range qq.Answers {
+		converted := make(map[string]interface{})
+		for key, value := range answer {
+			if key == "id" {
+				// answer ids belong to the question in the course they came from
+				continue
+			}
+			if name, ok := quizAnswerFields[key]; ok {
+				key = name
+			}
+			converted[key] = value
+		}
+		answers = append(answers, converted)
+	}
+	p := map[string]interface{}{
+		"question_name":      qq.QuestionName,
+		"question_type":      qq.QuestionType,
+		"question_text":      qq.QuestionText,
+		"points_possible":    qq.PointsPossible,
+		"correct_comments":   qq.CorrectComments,
+		"incorrect_comments": qq.IncorrectComments,
+		"neutral_comments":   qq.NeutralComments,
+		"position":           position,
+		"answers":            answers,
+	}
+	if qq.QuestionType == "matching_question" {
+		p["matching_answer_incorrect_matches"] = qq.incorrectMatches()
+	}
+	return p
+}
+
+// incorrectMatches lists the matches of a matching question that don't go
+// with any answer, one per line, which is how Canvas takes the distractors.
+// Canvas lists every match, so the ones that go with answers are left out.
+func (qq *QuizQuestion) incorrectMatches() string {
+	correct := make(map[string]bool)
+	for _, answer := range qq.Answers {
+		if right, ok := answer["right"].(string); ok {
+			correct[right] = true
+		}
+	}
+	distractors := make([]string, 0)
+	for _, match := range qq.Matches {
+		if text, ok := match["text"].(string); ok && !correct[text] {
+			distractors = append(distractors, text)
+		}
+	}
+	return strings.Join(distractors, "\n")
 }
 
 func (qq *QuizQuestion) Dump() error {
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetries    = 5
+	defaultMaxBackoff = 30 * time.Second
+	retryBaseDelay    = 500 * time.Millisecond
+
+	// Canvas gives each token a bucket of quota that requests drain and that
+	// refills over time. Once the bucket gets below rateLimitLowWater, requests
+	// are spaced out more the emptier it gets, up to rateLimitMaxDelay apart.
+	rateLimitLowWater = 200.0
+	rateLimitMaxDelay = 2 * time.Second
+)
+
+// rateLimiter keeps track of how much of Canvas's quota is left and slows
+// requests down before Canvas starts throttling them.
+type rateLimiter struct {
+	mu        sync.Mutex
+	remaining float64 // the last X-Rate-Limit-Remaining from Canvas, or -1 if unknown
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{remaining: -1}
+}
+
+// update records the remaining quota Canvas reported in the response.
+func (l *rateLimiter) update(resp *http.Response) {
+	remaining, err := strconv.ParseFloat(resp.Header.Get("X-Rate-Limit-Remaining"), 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	l.remaining = remaining
+	l.mu.Unlock()
+}
+
+// delay returns how long to wait before the next request.
+func (l *rateLimiter) delay() time.Duration {
+	l.mu.Lock()
+	remaining := l.remaining
+	l.mu.Unlock()
+	if remaining < 0 || remaining >= rateLimitLowWater {
+		return 0
+	}
+	return time.Duration(float64(rateLimitMaxDelay) * (rateLimitLowWater - remaining) / rateLimitLowWater)
+}
+
+// sendRequest sends a request to Canvas, first waiting if the rate limiter says
+// Canvas is about to throttle us. Requests that fail in ways that are likely
+// temporary are retried with jittered exponential backoff, up to c.Retries
+// times. The request is rebuilt for each attempt since sending consumes the
+// payload.
+func (c *CanvasClient) sendRequest(reqUrl string, params url.Values, method string, upload interface{}, download interface{}) (*http.Response, error) {
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		req, err := c.prepareRequest(reqUrl, params, method, upload, download)
+		if err != nil {
+			return nil, fmt.Errorf("error creating http request: %v", err)
+		}
+
+		if delay := c.Limiter.delay(); delay > 0 {
+			if c.Report {
+				c.Logger.Printf("Canvas rate limit is low, waiting %v", delay)
+			}
+			time.Sleep(delay)
+		}
+		resp, err := c.HttpClient.Do(req)
+		if err == nil {
+			c.Limiter.update(resp)
+		}
+
+		// an OAuth access token can be revoked or expire early; a fresh one
+		// might be accepted, and Canvas didn't act on the rejected request
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && c.OAuth != nil && !refreshed {
+			resp.Body.Close()
+			refreshed = true
+			rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if err := c.OAuth.refresh(rejected); err != nil {
+				return nil, err
+			}
+			attempt--
+			continue
+		}
+
+		reason := retryReason(method, resp, err)
+		if reason == "" || attempt >= c.Retries {
+			if err != nil {
+				return nil, fmt.Errorf("error connecting to %s: %v", req.URL.Host, err)
+			}
+			return resp, nil
+		}
+
+		delay := backoff(attempt, resp, c.MaxBackoff)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.Logger.Printf("%s %s: %s, retrying in %v", method, req.URL.Path, reason, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// retryReason says why the request is worth retrying, or returns "" if it
+// isn't. Throttled requests are never processed by Canvas, so they can always
+// be retried. Server errors and dropped connections might happen after Canvas
+// made the change, so only requests that are safe to repeat are retried then.
+func retryReason(method string, resp *http.Response, err error) string {
+	idempotent := method != "POST"
+	if err != nil {
+		if idempotent && isTemporaryNetworkError(err) {
+			return err.Error()
+		}
+		return ""
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || isThrottled(resp):
+		return "rate limit exceeded"
+	case idempotent && resp.StatusCode >= 500:
+		return resp.Status
+	}
+	return ""
+}
+
+func isTemporaryNetworkError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isThrottled reports whether the response is Canvas throttling us, which it
+// does with a 403 that says so in the body. The body is put back so it can still
+// be read if the request isn't retried.
+func isThrottled(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	raw, err := readBody(resp)
+	resp.Body.Close()
+	resp.Header.Del("Content-Encoding")
+	resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	return err == nil && strings.Contains(string(raw), "Rate Limit Exceeded")
+}
+
+// backoff returns how long to wait before the given retry: the base delay
+// doubled for each attempt so far, with jitter so concurrent requests don't
+// retry in lockstep. A Retry-After from Canvas is used instead if it's longer,
+// but the wait is still never more than maxBackoff.
+func backoff(attempt int, resp *http.Response, maxBackoff time.Duration) time.Duration {
+	delay := maxBackoff
+	if attempt < 30 && retryBaseDelay<<uint(attempt) < delay {
+		delay = retryBaseDelay << uint(attempt)
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			if retryAfter := time.Duration(seconds) * time.Second; retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	schemaVersionTable = "schema_version"
+)
+
+// A migration moves the db schema up one version. Migrations are run in order
+// and each one runs at most once per db, so once a migration has been released
+// it must never be edited. Schema changes always go in a new migration at the
+// end of the list.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create courses table",
+		statements: []string{
+			// dbs created before migrations existed already have this table
+			`CREATE TABLE IF NOT EXISTS courses (
+				"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+				"canvas_id" integer NOT NULL,
+				"name" TEXT NOT NULL,
+				"code" TEXT NOT NULL,
+				"workflow_state" TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version:     2,
+		description: "create component canvas ids table",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS component_canvas_ids (
+				"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+				"component_type" TEXT NOT NULL,
+				"component_id" TEXT NOT NULL,
+				"course_id" integer NOT NULL,
+				"canvas_id" integer NOT NULL,
+				UNIQUE (component_type, component_id, course_id)
+			);`,
+		},
+	},
+	{
+		version:     3,
+		description: "track sync state of components",
+		statements: []string{
+			`ALTER TABLE component_canvas_ids ADD COLUMN "updated_at" TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE component_canvas_ids ADD COLUMN "remote_hash" TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE component_canvas_ids ADD COLUMN "content_hash" TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version:     4,
+		description: "create file bases table",
+		statements: []string{
+			`CREATE TABLE file_bases (
+				"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+				"path" TEXT NOT NULL UNIQUE,
+				"content" TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version:     5,
+		description: "create settings table",
+		statements: []string{
+			`CREATE TABLE settings (
+				"key" TEXT NOT NULL PRIMARY KEY,
+				"value" TEXT NOT NULL
+			);`,
+		},
+	},
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + schemaVersionTable + ` (
+		"version" integer NOT NULL
+	);`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + schemaVersionTable).Scan(&version)
+	return version, err
+}
+
+// migrateDb brings the db schema up to date by running every migration newer
+// than the db's current version. Each migration runs in its own transaction so
+// a failure leaves the db at the last version that succeeded.
+func migrateDb(db *sql.DB) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range m.statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO "+schemaVersionTable+" (version) VALUES (?)", m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		current = m.version
+	}
+	return nil
+}
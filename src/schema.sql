@@ -1,54 +1,37 @@
-CREATE TABLE courses (
-    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-    canvas_id integer NOT NULL,
-    name text NOT NULL,
-    code text NOT NULL,
-    workflow_state text NOT NULL
+-- Reference copy of the schema built by the migrations in schema.go. The
+-- migrations are the source of truth; keep this in sync when adding one.
+
+CREATE TABLE schema_version (
+    version integer NOT NULL
 );
 
-CREATE TABLE pages (
+CREATE TABLE courses (
     id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-    url text NOT NULL,
-    title integer NOT NULL,
-    created_at text NOT NULL,
-    updated_at text NOT NULL,
-    body text NOT NULL
-    published integer NOT NULL,
-    front_page integer NOT NULL
+    canvas_id integer NOT NULL,
+    name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    workflow_state TEXT NOT NULL
 );
 
-CREATE TABLE modules (
+CREATE TABLE component_canvas_ids (
     id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    component_type TEXT NOT NULL,
+    component_id TEXT NOT NULL,
+    course_id integer NOT NULL,
     canvas_id integer NOT NULL,
-    position integer NOT NULL,
-    name text NOT NULL,
-    unlock_at text NOT NULL,
-    require_sequential_progress boolean
-    items_count integer NOT NULL,
-    items_url text NOT NULL,
-    published boolean not null
+    updated_at TEXT NOT NULL DEFAULT '',
+    remote_hash TEXT NOT NULL DEFAULT '',
+    content_hash TEXT NOT NULL DEFAULT '',
+    UNIQUE (component_type, component_id, course_id)
 );
 
-CREATE TABLE moduleitems (
+CREATE TABLE file_bases (
     id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-    canvas_id integer not null,
-    module_id integer not null,
-    position integer not null,
-    title text not null,
-    indent integer not null,
-    type text not null,
-    content_id integer not null,
-    html_url text not null,
-    url text not null,
-    page_url text not null,
-    external_url text not null,
-    new_tab boolean not null,
-    completion_requirement_id integer not null,
-    published boolean not null
+    path TEXT NOT NULL UNIQUE,
+    content TEXT NOT NULL
 );
 
-CREATE TABLE moduleprerequisites (
-    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-    module_id INTEGER,
-    prerequisite_module_id INTEGER
+CREATE TABLE settings (
+    key TEXT NOT NULL PRIMARY KEY,
+    value TEXT NOT NULL
 );
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// Settings are per-directory values kept in the db, e.g., the profile pinned
+// to the courses in this directory.
+const (
+	profileSetting = "profile"
+)
+
+// getSetting returns the value of a setting, or "" if it isn't set.
+func getSetting(db *sql.DB, key string) (string, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setSetting(db *sql.DB, key, value string) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func deleteSetting(db *sql.DB, key string) error {
+	_, err := db.Exec(`DELETE FROM settings WHERE key = ?`, key)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/russross/meddler"
+)
+
+const (
+	statusNewLocal       = "new-local"       // only exists locally
+	statusNewRemote      = "new-remote"      // only exists in Canvas
+	statusModifiedLocal  = "modified-local"  // changed locally since the last sync
+	statusModifiedRemote = "modified-remote" // changed in Canvas since the last sync
+	statusConflict       = "conflict"        // changed on both sides since the last sync
+	statusDeletedLocal   = "deleted-local"   // synced before, but the local file is gone
+	statusDeletedRemote  = "deleted-remote"  // synced before, but gone from Canvas
+	statusInSync         = "in-sync"
+)
+
+// The sync status of a single component in a single course
+type componentStatus struct {
+	componentType string
+	componentId   string
+	status        string
+}
+
+// syncStatus compares both sides of a component against the state recorded the
+// last time it was synced. mapping is nil if it has never been synced with the
+// course, and updatedAt and remoteHash are only meaningful if remoteFound.
+func syncStatus(mapping *ComponentCanvasId, contentHash string, remoteFound bool, updatedAt, remoteHash string) string {
+	if !remoteFound {
+		if mapping == nil {
+			return statusNewLocal
+		}
+		return statusDeletedRemote
+	}
+
+	// a component that exists on both sides but was never synced has an empty
+	// recorded state, so it shows up as changed on both sides
+	stored := new(ComponentCanvasId)
+	if mapping != nil {
+		stored = mapping
+	}
+	localChanged := contentHash != stored.ContentHash
+	remoteChanged := remoteHash != stored.RemoteHash
+	if updatedAt != "" && stored.UpdatedAt != "" {
+		// timestamps are more reliable than hashes when Canvas gives us one,
+		// since listings don't always include every field (e.g., page bodies)
+		remoteChanged = updatedAt != stored.UpdatedAt
+	}
+
+	switch {
+	case localChanged && remoteChanged:
+		return statusConflict
+	case localChanged:
+		return statusModifiedLocal
+	case remoteChanged:
+		return statusModifiedRemote
+	default:
+		return statusInSync
+	}
+}
+
+// kindStatus finds the status of every component of a single kind in the given
+// course, whether it exists locally, in Canvas, or both.
+func kindStatus(client *CanvasClient, db *sql.DB, course *Course, kind componentKind) ([]componentStatus, error) {
+	statuses := make([]componentStatus, 0)
+	locals, err := kind.loadComponents()
+	if err != nil {
+		return statuses, err
+	}
+	remotes, err := kind.list(client, course)
+	if err != nil {
+		return statuses, err
+	}
+	if len(locals) == 0 && len(remotes) == 0 {
+		return statuses, nil
+	}
+	componentType := remoteOrLocalType(locals, remotes)
+
+	// everything recorded for this kind in this course, by canvas id
+	var mappings []*ComponentCanvasId
+	err = meddler.QueryAll(db, &mappings, "SELECT * FROM "+componentCanvasIdsTable+
+		" WHERE component_type = ? AND course_id = ?", componentType, course.Id)
+	if err != nil {
+		return statuses, err
+	}
+	mapped := make(map[int]*ComponentCanvasId)
+	for _, mapping := range mappings {
+		mapped[mapping.CanvasId] = mapping
+	}
+
+	byId := make(map[int]Component)
+	bySlug := make(map[string]Component)
+	for _, remote := range remotes {
+		byId[remote.GetCanvasId()] = remote
+		bySlug[remote.Slug()] = remote
+	}
+
+	matched := make(map[int]bool)
+	for _, local := range locals {
+		mapping, err := findComponentCanvasId(db, local.ComponentType(), local.Slug(), course)
+		if err != nil {
+			return statuses, err
+		}
+		var remote Component
+		if mapping != nil {
+			remote = byId[mapping.CanvasId]
+		} else {
+			remote = bySlug[local.Slug()]
+		}
+
+		var updatedAt, remoteHash string
+		if remote != nil {
+			matched[remote.GetCanvasId()] = true
+			updatedAt, remoteHash, err = remoteState(client, course, remote)
+			if err != nil {
+				return statuses, err
+			}
+		}
+		contentHash, err := hashFiles(componentFiles(local)...)
+		if err != nil {
+			return statuses, err
+		}
+		status := syncStatus(mapping, contentHash, remote != nil, updatedAt, remoteHash)
+		statuses = append(statuses, componentStatus{local.ComponentType(), local.Slug(), status})
+	}
+
+	for _, remote := range remotes {
+		if matched[remote.GetCanvasId()] {
+			continue
+		}
+		status := statusNewRemote
+		componentId := remote.Slug()
+		if mapping, ok := mapped[remote.GetCanvasId()]; ok {
+			status = statusDeletedLocal
+			componentId = mapping.ComponentId
+		}
+		statuses = append(statuses, componentStatus{remote.ComponentType(), componentId, status})
+	}
+	return statuses, nil
+}
+
+func remoteOrLocalType(locals, remotes []Component) string {
+	if len(locals) > 0 {
+		return locals[0].ComponentType()
+	}
+	return remotes[0].ComponentType()
+}
+
+// syllabusStatus finds the status of the course's syllabus.
+func syllabusStatus(client *CanvasClient, db *sql.DB, course *Course) (componentStatus, error) {
+	status := componentStatus{syllabusComponentType, syllabusComponentId, ""}
+	remote, err := getCourse(client, course.CanvasId)
+	if err != nil {
+		return status, err
+	}
+	mapping, err := findComponentCanvasId(db, syllabusComponentType, syllabusComponentId, course)
+	if err != nil {
+		return status, err
+	}
+	contentHash, err := hashFiles(syllabusFile)
+	if err != nil {
+		return status, err
+	}
+	if contentHash == hashString("") && remote.Syllabus == "" {
+		status.status = statusInSync
+	} else {
+		status.status = syncStatus(mapping, contentHash, true, "", hashString(remote.Syllabus))
+	}
+	return status, nil
+}
+
+// courseStatus finds the status of every component in the given course.
+func courseStatus(client *CanvasClient, db *sql.DB, course *Course) ([]componentStatus, error) {
+	statuses := make([]componentStatus, 0)
+	for _, kind := range componentKinds {
+		kindStatuses, err := kindStatus(client, db, course, kind)
+		if err != nil {
+			return statuses, fmt.Errorf("failed to get status of %s: %v", kind.name, err)
+		}
+		statuses = append(statuses, kindStatuses...)
+	}
+	status, err := syllabusStatus(client, db, course)
+	if err != nil {
+		return statuses, fmt.Errorf("failed to get status of syllabus: %v", err)
+	}
+	statuses = append(statuses, status)
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].componentType != statuses[j].componentType {
+			return statuses[i].componentType < statuses[j].componentType
+		}
+		return statuses[i].componentId < statuses[j].componentId
+	})
+	return statuses, nil
+}
+
+func (status componentStatus) String() string {
+	return fmt.Sprintf("%-16s%-18s%s", status.status, status.componentType, status.componentId)
+}
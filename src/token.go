@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	tokenEnv      = "EASEL_TOKEN"
+	passphraseEnv = "EASEL_PASSPHRASE"
+	tokenDotFile  = "." + cmdName + "-tokens"
+
+	// where a profile's token is kept
+	tokenStoreKeyring = "keyring" // the Secret Service keyring, through secret-tool
+	tokenStoreFile    = "file"    // tokenDotFile, encrypted with a passphrase
+	tokenStoreEnv     = "env"     // nowhere; it comes from EASEL_TOKEN each time
+
+	keyringService   = cmdName
+	tokenKeyIter     = 200000
+	tokenKeySaltSize = 16
+)
+
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// loadToken returns the token for the given profile. EASEL_TOKEN overrides any
+// stored token, e.g., for running easel in CI.
+func loadToken(name string, profile *Profile) (string, error) {
+	if token := os.Getenv(tokenEnv); token != "" {
+		return token, nil
+	}
+	switch profile.TokenStore {
+	case tokenStoreKeyring:
+		return keyringLookup(name)
+	case tokenStoreFile:
+		return fileLookup(name)
+	case tokenStoreEnv:
+		return "", fmt.Errorf("profile %s gets its token from $%s, which is not set", name, tokenEnv)
+	}
+	// logins from before tokens were kept safe have it in the config file
+	if profile.Token == "" {
+		return "", fmt.Errorf("profile %s has no token; try running '%s login' again", name, os.Args[0])
+	}
+	return profile.Token, nil
+}
+
+// storeToken keeps the token for the given profile in the keyring if there is
+// one, or otherwise in the encrypted token file, and records where in the
+// profile.
+func storeToken(name string, profile *Profile, token string) error {
+	store := tokenStoreFile
+	if keyringAvailable() {
+		store = tokenStoreKeyring
+	}
+	if profile.TokenStore != "" && profile.TokenStore != store {
+		removeToken(name, profile)
+	}
+
+	var err error
+	if store == tokenStoreKeyring {
+		err = keyringStore(name, token)
+	} else {
+		err = fileStore(name, token)
+	}
+	if err != nil {
+		return err
+	}
+	profile.TokenStore = store
+	profile.Token = ""
+	return nil
+}
+
+// removeToken forgets the stored token for the given profile.
+func removeToken(name string, profile *Profile) error {
+	switch profile.TokenStore {
+	case tokenStoreKeyring:
+		return keyringRemove(name)
+	case tokenStoreFile:
+		return fileRemove(name)
+	}
+	return nil
+}
+
+// keyringAvailable reports whether there's a Secret Service keyring to use,
+// which needs secret-tool (from libsecret) and a desktop session.
+func keyringAvailable() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func keyringStore(name, token string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", fmt.Sprintf("%s token (%s)", appName, name),
+		"service", keyringService, "profile", name)
+	cmd.Stdin = strings.NewReader(token)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store token in keyring: %v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func keyringLookup(name string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "profile", name).Output()
+	if err != nil || len(out) == 0 {
+		return "", fmt.Errorf("no token for profile %s in keyring; try running '%s login' again", name, os.Args[0])
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func keyringRemove(name string) error {
+	if out, err := exec.Command("secret-tool", "clear", "service", keyringService, "profile", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove token from keyring: %v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// tokenFile holds tokens encrypted with AES-GCM, using a key derived from the
+// user's passphrase. Each token is sealed with its profile name as additional
+// data, so tokens can't be swapped between profiles.
+type tokenFile struct {
+	Salt       string            `json:"salt"`
+	Iterations int               `json:"iterations"`
+	Tokens     map[string]string `json:"tokens"`
+}
+
+// keys for the token file by salt, kept so the passphrase is only asked for
+// once
+var tokenKeys = make(map[string][]byte)
+
+func tokenFilePath() string {
+	return filepath.Join(filepath.Dir(rcPath()), tokenDotFile)
+}
+
+func readTokenFile() (*tokenFile, error) {
+	tf := &tokenFile{Tokens: make(map[string]string)}
+	raw, err := ioutil.ReadFile(tokenFilePath())
+	if os.IsNotExist(err) {
+		return tf, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, tf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", tokenFilePath(), err)
+	}
+	if tf.Tokens == nil {
+		tf.Tokens = make(map[string]string)
+	}
+	return tf, nil
+}
+
+func writeTokenFile(tf *tokenFile) error {
+	raw, err := json.MarshalIndent(tf, "", "    ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+	path := tokenFilePath()
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return err
+	}
+	// WriteFile leaves the mode of an existing file alone
+	return os.Chmod(path, 0600)
+}
+
+// unlock returns the AES-GCM cipher for the token file, asking for the
+// passphrase if needed. A new file gets a new salt. The passphrase is checked
+// against a token already in the file, if there is one.
+func (tf *tokenFile) unlock() (cipher.AEAD, error) {
+	if tf.Salt == "" {
+		salt := make([]byte, tokenKeySaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		tf.Salt = base64.StdEncoding.EncodeToString(salt)
+		tf.Iterations = tokenKeyIter
+	}
+	salt, err := base64.StdEncoding.DecodeString(tf.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt salt in %s: %v", tokenFilePath(), err)
+	}
+
+	key, ok := tokenKeys[tf.Salt]
+	if !ok {
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", tokenFilePath()))
+		if err != nil {
+			return nil, err
+		}
+		key = pbkdf2Sha256([]byte(passphrase), salt, tf.Iterations, 32)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range tf.Tokens {
+		if _, err := tf.open(aead, name); err != nil {
+			return nil, err
+		}
+		break
+	}
+	tokenKeys[tf.Salt] = key
+	return aead, nil
+}
+
+func (tf *tokenFile) open(aead cipher.AEAD, name string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(tf.Tokens[name])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("corrupt token for profile %s in %s", name, tokenFilePath())
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", errWrongPassphrase
+	}
+	return string(token), nil
+}
+
+func fileStore(name, token string) error {
+	tf, err := readTokenFile()
+	if err != nil {
+		return err
+	}
+	aead, err := tf.unlock()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(name))
+	tf.Tokens[name] = base64.StdEncoding.EncodeToString(sealed)
+	return writeTokenFile(tf)
+}
+
+func fileLookup(name string) (string, error) {
+	tf, err := readTokenFile()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := tf.Tokens[name]; !ok {
+		return "", fmt.Errorf("no token for profile %s in %s; try running '%s login' again", name, tokenFilePath(), os.Args[0])
+	}
+	aead, err := tf.unlock()
+	if err != nil {
+		return "", err
+	}
+	return tf.open(aead, name)
+}
+
+func fileRemove(name string) error {
+	tf, err := readTokenFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := tf.Tokens[name]; !ok {
+		return nil
+	}
+	delete(tf.Tokens, name)
+	return writeTokenFile(tf)
+}
+
+// readPassphrase reads the passphrase for the token file from EASEL_PASSPHRASE,
+// or else from the terminal.
+func readPassphrase(prompt string) (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := readSecret(prompt)
+	if err != nil {
+		return "", fmt.Errorf("no passphrase given; set $%s when not running interactively", passphraseEnv)
+	}
+	return passphrase, nil
+}
+
+// readSecret reads a line from the terminal without echoing it.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := stdin.ReadString('\n')
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		if err == nil {
+			err = errors.New("nothing entered")
+		}
+		return "", err
+	}
+	return secret, nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// pbkdf2Sha256 derives a key from a password as in RFC 8018, section 5.2,
+// using HMAC-SHA256.
+func pbkdf2Sha256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen)
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
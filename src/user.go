@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	selfPath = "/users/self"
+)
+
+// User is the Canvas user a token belongs to.
+type User struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	LoginId   string `json:"login_id"`
+	AvatarUrl string `json:"avatar_url"`
+}
+
+// getSelf returns the user the client's token belongs to.
+func getSelf(client *CanvasClient) (*User, error) {
+	user := new(User)
+	err := client.getObject(selfPath, nil, user)
+	return user, err
+}
+
+func (user *User) String() string {
+	if user.LoginId == "" {
+		return user.Name
+	}
+	return fmt.Sprintf("%s (%s)", user.Name, user.LoginId)
+}